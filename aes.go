@@ -6,6 +6,7 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"fmt"
 	"io"
 	"log"
 
@@ -24,6 +25,11 @@ func GeneratePass() []byte {
 }
 
 func Crypt(pass []byte, plaintext []byte) ([]byte, []byte, error) {
+	return CryptWithData(pass, plaintext, nil)
+}
+
+// like Crypt but the ciphertext only opens with the same additional data
+func CryptWithData(pass []byte, plaintext []byte, additionalData []byte) ([]byte, []byte, error) {
 
 	//hash := sha256.Sum256(pass)
 	block, e := aes.NewCipher(pass)
@@ -32,7 +38,8 @@ func Crypt(pass []byte, plaintext []byte) ([]byte, []byte, error) {
 		return nil, nil, e
 	}
 
-	// Never use more than 2^32 random nonces with a given key because of the risk of a repeat.
+	// Never use more than 2^32 random nonces with a given key because of the risk of a repeat,
+	// ledger keys are held well under that by reserveKeyUse.
 	nonce := make([]byte, 12)
 	if _, e := io.ReadFull(rand.Reader, nonce); e != nil {
 		log.Printf("Failed to read from crypto/rand: %s", e)
@@ -45,11 +52,19 @@ func Crypt(pass []byte, plaintext []byte) ([]byte, []byte, error) {
 		return nil, nil, e
 	}
 
-	cipherBuf := aesgcm.Seal(nil, nonce, plaintext, nil)
+	cipherBuf := aesgcm.Seal(nil, nonce, plaintext, additionalData)
 	return cipherBuf, nonce, nil
 }
 
 func Decrypt(pass []byte, ciphertext []byte) ([]byte, error) {
+	return DecryptWithData(pass, ciphertext, nil)
+}
+
+func DecryptWithData(pass []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+
+	if len(ciphertext) < 12 {
+		return nil, fmt.Errorf("Ciphertext is too short")
+	}
 
 	//hash := sha256.Sum256(pass)
 	block, e := aes.NewCipher(pass)
@@ -64,11 +79,18 @@ func Decrypt(pass []byte, ciphertext []byte) ([]byte, error) {
 		return nil, e
 	}
 
-	plaintext, e := aesgcm.Open(nil, ciphertext[:12], ciphertext[12:], nil)
+	plaintext, e := aesgcm.Open(nil, ciphertext[:12], ciphertext[12:], additionalData)
 	if e != nil {
 		log.Printf("Failed to open sealed text: %s", e)
 		return nil, e
 	}
 
 	return plaintext, nil
-}
\ No newline at end of file
+}
+
+// overwrite key material once it is no longer needed
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,703 @@
+package thorne
+
+import (
+
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+)
+
+// ******************************************************
+// Agent
+// Unlocks a keystore once and serves key operations to other
+// local processes over a unix socket so the keys never leave it
+// ******************************************************
+const AGENT_SOCKET_ENV = "THORNE_AUTH_SOCK"
+
+const (
+
+	AGENT_OP_PUBLIC_KEYS 		= "public-keys" 		// identity and rsa public keys
+	AGENT_OP_SIGN 					= "sign" 						// sign a sha256 digest with the identity key
+	AGENT_OP_DECRYPT 				= "decrypt" 				// decrypt with the rsa key
+	AGENT_OP_LEDGER_ENCRYPT = "ledger-encrypt" 	// encrypt with a ledger key
+	AGENT_OP_LEDGER_DECRYPT = "ledger-decrypt" 	// decrypt with a ledger key
+	AGENT_OP_LEDGERS 				= "ledgers" 				// the ledgers without their keys
+	AGENT_OP_LOCK 					= "lock"
+	AGENT_OP_UNLOCK 				= "unlock"
+
+)
+
+var ErrAgentLocked 				= errors.New("Agent is Locked")
+var ErrAgentDenied 				= errors.New("Agent Request Denied")
+
+type AgentRequest struct {
+
+	Op 											string
+	Ledger 									string 					// ledger UUID for the ledger operations
+	Author 									string 					// the block's author, bound into what the ledger operations seal
+	BlockType 							string
+	Date 										string
+	Data 										[]byte 					// digest, ciphertext, plaintext or password depending on Op
+	OAEP 										bool 						// AGENT_OP_DECRYPT with OAEP (sha256) instead of PKCS#1 v1.5
+
+}
+
+type AgentResponse struct {
+
+	Success 								bool
+	Error 									string
+	Data 										[]byte
+	UUID 										string 					// only set for AGENT_OP_PUBLIC_KEYS
+	PublicUUID 							string
+	PublicKey 							[]byte 					// marshalled P-521 identity key
+	RSAKey 									[]byte 					// PKCS1 rsa public key
+	Ledgers 								[]NewLedger 		// only set for AGENT_OP_LEDGERS
+
+}
+
+// the process on the other end of an agent connection
+type AgentPeer struct {
+
+	PID 										int
+	UID 										int
+
+}
+
+type Agent struct {
+
+	Filename 								string 					// keystore to unlock from
+	IdleTimeout 						time.Duration 	// lock after this long without a request, 0 never locks
+	Approve 								func(peer AgentPeer, op string) bool 		// asked once per connection, nil approves the agent's own user
+
+	ks 											*KeyStore
+	pass 										[]byte 					// kept while unlocked to write key use counts back
+	sealed 									bool 						// ledger keys were used since the counts were last written
+	lastUsed 								time.Time
+	mu 											sync.Mutex
+	ops 										sync.RWMutex 		// held for reading while an operation uses ks so it isn't wiped underneath
+
+}
+
+func NewAgent(filename string, pass []byte, idleTimeout time.Duration) (*Agent, error) {
+
+	a := &Agent{Filename: filename, IdleTimeout: idleTimeout}
+	if e := a.Unlock(pass); e != nil {
+		return nil, e
+	}
+
+	return a, nil
+}
+
+func (a *Agent) Unlock(pass []byte) error {
+
+	// ReadKeyStore signs up a new user when the file is missing which an agent should never do
+	if _, e := os.Stat(a.Filename); e != nil {
+		log.Printf("Agent: Failed to read keystore: %s", e)
+		return e
+	}
+
+	ks, e := ReadKeyStore(pass, a.Filename)
+	if e != nil {
+		return e
+	}
+
+	a.replace(ks, append([]byte{}, pass...))
+	return nil
+}
+
+// drop the keys from memory until the next Unlock
+func (a *Agent) Lock() {
+
+	if a.replace(nil, nil) {
+		log.Printf("Agent: Locked")
+	}
+}
+
+// swap in ks and wipe the keystore it replaces once nothing is using it, false when there wasn't one
+func (a *Agent) replace(ks *KeyStore, pass []byte) bool {
+
+	a.mu.Lock()
+	old, oldPass, sealed := a.ks, a.pass, a.sealed
+	a.ks, a.pass, a.sealed = ks, pass, false
+	a.lastUsed = time.Now()
+	a.mu.Unlock()
+
+	defer wipe(oldPass)
+	if old == nil {
+		return false
+	}
+
+	// operations that picked up the old keystore finish before it's wiped, later ones see the new one
+	a.ops.Lock()
+	defer a.ops.Unlock()
+
+	if sealed {
+		a.writeKeyUses(old, oldPass)
+	}
+
+	for _, k := range []*ecdsa.PrivateKey{old.PrivateKey, old.PublicUserKey, old.DeviceKey, old.PendingIdentityKey} {
+		if k != nil {
+			k.D.SetInt64(0)
+		}
+	}
+
+	if old.RSAKey != nil {
+		old.RSAKey.D.SetInt64(0)
+		for _, p := range old.RSAKey.Primes {
+			p.SetInt64(0)
+		}
+	}
+
+	for _, v := range old.LedgerKeys {
+		wipe(v.SharedSecret)
+		for _, secret := range v.Epochs {
+			wipe(secret)
+		}
+	}
+
+	return true
+}
+
+// listen on the unix socket until the listener fails
+func (a *Agent) Serve(socketPath string) error {
+
+	l, e := listenPrivate(socketPath)
+	if e != nil {
+		log.Printf("Agent: Failed to listen on %s: %s", socketPath, e)
+		return e
+	}
+	defer os.Remove(socketPath)
+	defer l.Close()
+
+	go a.maintain()
+
+	for {
+		c, e := l.Accept()
+		if e != nil {
+			log.Printf("Agent: Accept Failed: %s", e)
+			return e
+		}
+
+		go a.handle(c.(*net.UnixConn))
+	}
+}
+
+// the socket is made inside a fresh 0700 directory and only moved to socketPath once it's
+// 0600, so there's no moment anyone else can connect to it. an existing socket is only
+// replaced when nothing is listening on it
+func listenPrivate(socketPath string) (*net.UnixListener, error) {
+
+	if fi, e := os.Lstat(socketPath); e == nil {
+		if fi.Mode() & os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", socketPath)
+		}
+
+		if c, e := net.Dial("unix", socketPath); e == nil {
+			c.Close()
+			return nil, fmt.Errorf("An Agent is already listening on %s", socketPath)
+		}
+	}
+
+	dir, e := os.MkdirTemp(filepath.Dir(socketPath), ".thorne-agent-")
+	if e != nil {
+		return nil, e
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	l, e := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if e != nil {
+		return nil, e
+	}
+
+	// the socket is removed from socketPath by Serve, not from where it was made
+	l.SetUnlinkOnClose(false)
+
+	if e := os.Chmod(tmp, 0600); e != nil {
+		l.Close()
+		return nil, e
+	}
+
+	if e := os.Rename(tmp, socketPath); e != nil {
+		l.Close()
+		return nil, e
+	}
+
+	return l, nil
+}
+
+// lock when idle and keep the keystore's key use counts up to date
+func (a *Agent) maintain() {
+
+	period := time.Minute
+	if a.IdleTimeout > 0 && a.IdleTimeout / 4 + time.Second < period {
+		period = a.IdleTimeout / 4 + time.Second
+	}
+
+	t := time.NewTicker(period)
+	defer t.Stop()
+
+	for range t.C {
+		a.mu.Lock()
+		idle := a.IdleTimeout > 0 && a.ks != nil && time.Since(a.lastUsed) > a.IdleTimeout
+		a.mu.Unlock()
+
+		if idle {
+			a.Lock()
+		} else {
+			a.flushKeyUses()
+		}
+	}
+}
+
+func (a *Agent) flushKeyUses() {
+
+	a.ops.RLock()
+	defer a.ops.RUnlock()
+
+	a.mu.Lock()
+	ks, pass, sealed := a.ks, a.pass, a.sealed
+	a.sealed = false
+	a.mu.Unlock()
+
+	if ks != nil && sealed {
+		a.writeKeyUses(ks, pass)
+	}
+}
+
+// blocks sealed here count against the ledger keys like any others, so the counts go back
+// into the keystore file. it's read again first so nothing else written to it is lost
+func (a *Agent) writeKeyUses(ks *KeyStore, pass []byte) {
+
+	if _, e := os.Stat(a.Filename); e != nil {
+		log.Printf("Agent: Failed to read keystore: %s", e)
+		return
+	}
+
+	disk, e := ReadKeyStore(pass, a.Filename)
+	if e != nil {
+		log.Printf("Agent: Failed to read keystore: %s", e)
+		return
+	}
+
+	ks.mu.RLock()
+	counts := map[string]SharedKey{}
+	for k, v := range ks.LedgerKeys {
+		counts[k] = SharedKey{Epoch: v.Epoch, Uses: v.Uses}
+	}
+	ks.mu.RUnlock()
+
+	changed := false
+	for uuid, used := range counts {
+		disk.UpdateLedgerKey(uuid, func(key *SharedKey) error {
+			if key.Epoch == used.Epoch && key.Uses < used.Uses {
+				key.Uses = used.Uses
+				changed = true
+			}
+			return nil
+		})
+	}
+
+	if !changed {
+		return
+	}
+
+	if e := WriteKeyStore(pass, a.Filename, disk); e != nil {
+		log.Printf("Agent: Failed to write key uses: %s", e)
+	}
+}
+
+func (a *Agent) handle(c *net.UnixConn) {
+
+	defer c.Close()
+
+	peer, e := peerCredentials(c)
+	if e != nil {
+		log.Printf("Agent: Failed to read peer credentials: %s", e)
+		return
+	}
+
+	dec := json.NewDecoder(c)
+	enc := json.NewEncoder(c)
+	approved := map[string]bool{}
+
+	for {
+		req := AgentRequest{}
+		if e := dec.Decode(&req); e != nil {
+			return
+		}
+
+		if _, ok := approved[req.Op]; !ok {
+			approved[req.Op] = a.approve(peer, req.Op)
+		}
+
+		res := &AgentResponse{}
+		if !approved[req.Op] {
+			log.Printf("Agent: Denied %s for pid %d uid %d", req.Op, peer.PID, peer.UID)
+			res.Error = ErrAgentDenied.Error()
+		} else if e := a.do(&req, res); e != nil {
+			res.Error = e.Error()
+		} else {
+			res.Success = true
+		}
+
+		if e := enc.Encode(res); e != nil {
+			log.Printf("Agent: Failed to write response: %s", e)
+			return
+		}
+	}
+}
+
+func (a *Agent) approve(peer AgentPeer, op string) bool {
+
+	// never serve other users regardless of what the callback thinks
+	if peer.UID != os.Getuid() {
+		return false
+	}
+
+	if a.Approve == nil {
+		return true
+	}
+
+	return a.Approve(peer, op)
+}
+
+func (a *Agent) do(req *AgentRequest, res *AgentResponse) error {
+
+	switch req.Op {
+	case AGENT_OP_LOCK:
+		a.Lock()
+		return nil
+	case AGENT_OP_UNLOCK:
+		defer wipe(req.Data)
+		return a.Unlock(req.Data)
+	}
+
+	a.ops.RLock()
+	defer a.ops.RUnlock()
+
+	a.mu.Lock()
+	ks := a.ks
+	a.lastUsed = time.Now()
+	a.mu.Unlock()
+
+	if ks == nil {
+		return ErrAgentLocked
+	}
+
+	var e error
+	switch req.Op {
+	case AGENT_OP_PUBLIC_KEYS, AGENT_OP_SIGN:
+		if ks.PrivateKey == nil {
+			return ErrNoIdentityKey
+		}
+	}
+
+	switch req.Op {
+	case AGENT_OP_PUBLIC_KEYS:
+		res.UUID = ks.UUID
+		res.PublicUUID = ks.PublicUUID
+		res.PublicKey = elliptic.Marshal(elliptic.P521(), ks.PrivateKey.PublicKey.X, ks.PrivateKey.PublicKey.Y)
+		res.RSAKey = x509.MarshalPKCS1PublicKey(rsaGetPublicKey(ks.RSAKey))
+	case AGENT_OP_SIGN:
+		if len(req.Data) != sha256.Size {
+			return fmt.Errorf("Expected a sha256 digest")
+		}
+		res.Data, e = ecdsa.SignASN1(rand.Reader, ks.PrivateKey, req.Data)
+	case AGENT_OP_DECRYPT:
+		if ks.RSAKey == nil {
+			return ErrNoRSAKey
+		}
+
+		if req.OAEP {
+			res.Data, e = rsa.DecryptOAEP(sha256.New(), nil, ks.RSAKey, req.Data, nil)
+		} else {
+			res.Data, e = rsa.DecryptPKCS1v15(nil, ks.RSAKey, req.Data)
+		}
+	case AGENT_OP_LEDGER_ENCRYPT:
+		// sealed like WriteBlock would so the block is bound to where it goes and the key's uses are counted
+		key, err := reserveKeyUse(ks, req.Ledger, false)
+		if err != nil {
+			return err
+		}
+		res.Data, e = SealBlock(key.SharedSecret, key.Epoch, req.Ledger, ks.UUID, req.BlockType, req.Date, req.Data)
+
+		a.mu.Lock()
+		a.sealed = true
+		a.mu.Unlock()
+	case AGENT_OP_LEDGERS:
+		res.Ledgers = ks.LedgerList()
+	case AGENT_OP_LEDGER_DECRYPT:
+		key, ok := ks.LedgerKey(req.Ledger)
+		if !ok {
+			return fmt.Errorf("No Ledger Key for UUID: %s", req.Ledger)
+		}
+		res.Data, e = OpenBlock(key, req.Ledger, &NewBlock{UUID: req.Author, Ledger: req.Ledger, BlockType: req.BlockType, Date: req.Date}, req.Data)
+
+		// counted here like CheckLedger would since clients never see the key
+		if e == nil && req.Author != ks.UUID {
+			countKeyUse(ks, req.Ledger, blockEpoch(req.Data))
+
+			a.mu.Lock()
+			a.sealed = true
+			a.mu.Unlock()
+		}
+	default:
+		return fmt.Errorf("Unknown Agent Op: %s", req.Op)
+	}
+
+	return e
+}
+
+// ******************************************************
+// Agent Client
+// ******************************************************
+type AgentClient struct {
+
+	conn 										net.Conn
+	enc 										*json.Encoder
+	dec 										*json.Decoder
+	mu 											sync.Mutex
+
+}
+
+// connect to the agent at socketPath or $THORNE_AUTH_SOCK when empty
+func DialAgent(socketPath string) (*AgentClient, error) {
+
+	if socketPath == "" {
+		socketPath = os.Getenv(AGENT_SOCKET_ENV)
+	}
+
+	if socketPath == "" {
+		return nil, fmt.Errorf("No Agent Socket, set %s", AGENT_SOCKET_ENV)
+	}
+
+	c, e := net.Dial("unix", socketPath)
+	if e != nil {
+		log.Printf("Failed to connect to agent: %s", e)
+		return nil, e
+	}
+
+	return &AgentClient{conn: c, enc: json.NewEncoder(c), dec: json.NewDecoder(c)}, nil
+}
+
+func (c *AgentClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *AgentClient) call(req AgentRequest) (*AgentResponse, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e := c.enc.Encode(req); e != nil {
+		log.Printf("Failed to send agent request: %s", e)
+		return nil, e
+	}
+
+	res := &AgentResponse{}
+	if e := c.dec.Decode(res); e != nil {
+		log.Printf("Failed to read agent response: %s", e)
+		return nil, e
+	}
+
+	if !res.Success {
+		switch res.Error {
+		case ErrAgentLocked.Error():
+			return nil, ErrAgentLocked
+		case ErrAgentDenied.Error():
+			return nil, ErrAgentDenied
+		}
+		return nil, errors.New(res.Error)
+	}
+
+	return res, nil
+}
+
+func (c *AgentClient) PublicKeys() (*AgentResponse, error) {
+	return c.call(AgentRequest{Op: AGENT_OP_PUBLIC_KEYS})
+}
+
+// sign a sha256 digest with the identity key, the signature is ASN.1 encoded
+func (c *AgentClient) SignDigest(digest []byte) ([]byte, error) {
+
+	res, e := c.call(AgentRequest{Op: AGENT_OP_SIGN, Data: digest})
+	if e != nil {
+		return nil, e
+	}
+
+	return res.Data, nil
+}
+
+func (c *AgentClient) RSADecrypt(ciphertext []byte, oaep bool) ([]byte, error) {
+
+	res, e := c.call(AgentRequest{Op: AGENT_OP_DECRYPT, Data: ciphertext, OAEP: oaep})
+	if e != nil {
+		return nil, e
+	}
+
+	return res.Data, nil
+}
+
+// seal the contents of a block the agent's user is writing, returns the body the block carries
+func (c *AgentClient) LedgerEncrypt(ledgerUUID string, blockType string, date string, plaintext []byte) ([]byte, error) {
+
+	res, e := c.call(AgentRequest{Op: AGENT_OP_LEDGER_ENCRYPT, Ledger: ledgerUUID, BlockType: blockType, Date: date, Data: plaintext})
+	if e != nil {
+		return nil, e
+	}
+
+	return res.Data, nil
+}
+
+func (c *AgentClient) LedgerDecrypt(ledgerUUID string, block *NewBlock, body []byte) ([]byte, error) {
+
+	res, e := c.call(AgentRequest{Op: AGENT_OP_LEDGER_DECRYPT, Ledger: ledgerUUID, Author: block.UUID, BlockType: block.BlockType, Date: block.Date, Data: body})
+	if e != nil {
+		return nil, e
+	}
+
+	return res.Data, nil
+}
+
+func (c *AgentClient) Lock() error {
+	_, e := c.call(AgentRequest{Op: AGENT_OP_LOCK})
+	return e
+}
+
+func (c *AgentClient) Unlock(pass []byte) error {
+	_, e := c.call(AgentRequest{Op: AGENT_OP_UNLOCK, Data: pass})
+	return e
+}
+
+// the agent's identity key for use as KeyStore.Signer
+func (c *AgentClient) Signer() (crypto.Signer, error) {
+
+	res, e := c.PublicKeys()
+	if e != nil {
+		return nil, e
+	}
+
+	x, y := elliptic.Unmarshal(elliptic.P521(), res.PublicKey)
+	if x == nil {
+		return nil, fmt.Errorf("Agent returned an invalid public key")
+	}
+
+	return &agentSigner{c: c, public: &ecdsa.PublicKey{Curve: elliptic.P521(), X: x, Y: y}}, nil
+}
+
+// the agent's rsa key for use as KeyStore.Decrypter
+func (c *AgentClient) Decrypter() (crypto.Decrypter, error) {
+
+	res, e := c.PublicKeys()
+	if e != nil {
+		return nil, e
+	}
+
+	public, e := x509.ParsePKCS1PublicKey(res.RSAKey)
+	if e != nil {
+		log.Printf("Agent returned an invalid rsa key: %s", e)
+		return nil, e
+	}
+
+	return &agentDecrypter{c: c, public: public}, nil
+}
+
+func (c *AgentClient) Ledgers() ([]NewLedger, error) {
+
+	res, e := c.call(AgentRequest{Op: AGENT_OP_LEDGERS})
+	if e != nil {
+		return nil, e
+	}
+
+	return res.Ledgers, nil
+}
+
+// a keystore whose identity, rsa and ledger keys all stay in the agent, it holds none of its own.
+// ledgers keyed after this, by key exchanges or rotations, are kept here like any other keystore's
+func NewAgentKeyStore(c *AgentClient) (*KeyStore, error) {
+
+	res, e := c.PublicKeys()
+	if e != nil {
+		return nil, e
+	}
+
+	signer, e := c.Signer()
+	if e != nil {
+		return nil, e
+	}
+
+	decrypter, e := c.Decrypter()
+	if e != nil {
+		return nil, e
+	}
+
+	// the ledgers have to be known or private ones would look public and be written in the clear
+	ledgers, e := c.Ledgers()
+	if e != nil {
+		return nil, e
+	}
+
+	return &KeyStore{UUID: res.UUID, PublicUUID: res.PublicUUID, Signer: signer, Decrypter: decrypter, LedgerCipher: c, Connections: []Connection{}, LedgerKeys: map[string]SharedKey{}, Ledgers: append([]NewLedger{}, ledgers...), PendingConnections: map[string]SharedKey{}, Metadata: map[string]string{}}, nil
+}
+
+type agentSigner struct {
+
+	c 											*AgentClient
+	public 									*ecdsa.PublicKey
+
+}
+
+func (s *agentSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *agentSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("Agent only signs sha256 digests")
+	}
+
+	return s.c.SignDigest(digest)
+}
+
+type agentDecrypter struct {
+
+	c 											*AgentClient
+	public 									*rsa.PublicKey
+
+}
+
+func (d *agentDecrypter) Public() crypto.PublicKey {
+	return d.public
+}
+
+func (d *agentDecrypter) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+
+	switch o := opts.(type) {
+	case nil, *rsa.PKCS1v15DecryptOptions:
+		return d.c.RSADecrypt(msg, false)
+	case *rsa.OAEPOptions:
+		if o.Hash != crypto.SHA256 || len(o.Label) > 0 {
+			return nil, fmt.Errorf("Agent only supports OAEP with sha256 and no label")
+		}
+		return d.c.RSADecrypt(msg, true)
+	}
+
+	return nil, fmt.Errorf("Unsupported Agent Decrypt Options: %T", opts)
+}
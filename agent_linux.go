@@ -0,0 +1,31 @@
+package thorne
+
+import (
+
+	"net"
+	"syscall"
+
+)
+
+// ask the kernel who is on the other end of the socket
+func peerCredentials(c *net.UnixConn) (AgentPeer, error) {
+
+	raw, e := c.SyscallConn()
+	if e != nil {
+		return AgentPeer{}, e
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	if e := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); e != nil {
+		return AgentPeer{}, e
+	}
+
+	if credErr != nil {
+		return AgentPeer{}, credErr
+	}
+
+	return AgentPeer{PID: int(cred.Pid), UID: int(cred.Uid)}, nil
+}
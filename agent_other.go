@@ -0,0 +1,15 @@
+//go:build !linux
+
+package thorne
+
+import (
+
+	"net"
+	"os"
+
+)
+
+// without SO_PEERCRED rely on the socket's 0600 mode and treat the peer as ourselves
+func peerCredentials(c *net.UnixConn) (AgentPeer, error) {
+	return AgentPeer{PID: -1, UID: os.Getuid()}, nil
+}
@@ -0,0 +1,125 @@
+package thorne
+
+import (
+
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+)
+
+// a keystore backed by the agent writes and reads a private ledger without ever holding its key
+func TestAgentKeyStore(t *testing.T) {
+
+	owner := &KeyStore{UUID: "owner", PrivateKey: GenerateKey(), PublicUserKey: GenerateKey()}
+	owner.RSAKey, _ = rsaGenerateKey()
+	owner.AddLedger(NewLedger{UUID: "ledger", LedgerType: LEDGER_TYPE_PRIVATE})
+	owner.SetLedgerKey("ledger", SharedKey{SharedSecret: GeneratePass(), Epoch: 1})
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "keystore")
+	if e := WriteKeyStore([]byte("password"), filename, owner); e != nil {
+		t.Fatal(e)
+	}
+
+	a, e := NewAgent(filename, []byte("password"), 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	socket := filepath.Join(dir, "agent.sock")
+	go a.Serve(socket)
+
+	var c *AgentClient
+	for i := 0; i < 50; i++ {
+		if c, e = DialAgent(socket); e == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer c.Close()
+
+	ks, e := NewAgentKeyStore(c)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if ks.UUID != owner.UUID || ks.PrivateKey != nil || ks.RSAKey != nil {
+		t.Fatalf("Expected only the agent's public identity, have %s", ks.UUID)
+	}
+
+	if _, ok := ks.LedgerKey("ledger"); ok {
+		t.Fatal("Ledger Key left the agent")
+	}
+
+	ledger, _ := GetLedger(ks, "ledger")
+	if ledger == nil || ledger.LedgerType != LEDGER_TYPE_PRIVATE {
+		t.Fatal("Agent didn't hand over its ledgers")
+	}
+
+	br, release, e := prepareBlock(ks, "ledger", MessageType, "hello", nil, SIGNATURE_V2)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if release != nil {
+		release()
+	}
+
+	payload, e := blockSigningPayload(br.SignatureVersion, br)
+	if e != nil {
+		t.Fatal(e)
+	}
+	digest := sha256.Sum256(payload)
+	if !VerifyDigestSignature(&owner.PrivateKey.PublicKey, br.Signature, digest[:]) {
+		t.Fatal("Block isn't signed with the agent's identity key")
+	}
+
+	if contents, _ := base64.StdEncoding.DecodeString(br.Block.Contents); string(contents) == "hello" {
+		t.Fatal("Block written in the clear")
+	}
+
+	if key, _ := a.ks.LedgerKey("ledger"); key.Uses != 1 {
+		t.Fatalf("Expected the agent to count 1 use, have %d", key.Uses)
+	}
+
+	// read it back the way GetBlockStream would
+	f, e := ioutil.TempFile(dir, "block")
+	if e != nil {
+		t.Fatal(e)
+	}
+	f.WriteString(br.Block.Contents)
+
+	bs := &BlockStream{Block: br, contents: f}
+	defer bs.Close()
+
+	r, e := bs.Open(ks, ledger)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if b, e := ioutil.ReadAll(r); e != nil || string(b) != "hello" {
+		t.Fatalf("Failed to Open Block: %q %v", b, e)
+	}
+
+	// someone else's block is counted by the agent when it's opened
+	key, _ := owner.LedgerKey("ledger")
+	body, e := SealBlock(key.SharedSecret, key.Epoch, "ledger", "other", MessageType, br.Block.Date, []byte("hi"))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	other := &BlockRequest{Block: NewBlock{UUID: "other", Ledger: "ledger", Date: br.Block.Date, BlockType: MessageType, Contents: base64.StdEncoding.EncodeToString(body)}}
+	if e := runBlock(ks, ledger, other); e != nil {
+		t.Fatal(e)
+	}
+
+	if key, _ := a.ks.LedgerKey("ledger"); key.Uses != 2 {
+		t.Fatalf("Expected the agent to count 2 uses, have %d", key.Uses)
+	}
+}
@@ -0,0 +1,80 @@
+package thorne
+
+import (
+
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+)
+
+// ******************************************************
+// Alias
+// Posting to public ledgers as PublicUUID, signed by PublicUserKey.
+// Nothing sent with an alias block names the primary UUID or its
+// keys and it goes over its own connection so the two can't be tied
+// together by the requests
+// ******************************************************
+
+var ErrNoAlias 						= errors.New("KeyStore has no Alias Identity")
+var ErrAliasLedger 				= errors.New("Alias Blocks can only be written to Public Ledgers")
+
+// a client that shares no connections with the rest of the package
+var aliasClient = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, DisableKeepAlives: true}}
+
+func WriteAliasBlock(ks *KeyStore, ledgerUUID string, blockType string, content string) error {
+
+	for i := 0; ; i++ {
+		br, e := prepareAliasBlock(ks, ledgerUUID, blockType, content)
+		if e != nil {
+			return e
+		}
+
+		_, e = postBlock(aliasClient, br)
+		if e != ErrStaleParent || i >= BlockWriteRetries {
+			return e
+		}
+
+		log.Printf("Ledger %s moved on while writing, signing over the new Last Block", ledgerUUID)
+	}
+}
+
+// like prepareBlock but as the alias, which has no device keys and never seals anything. the
+// ledger is looked up as the alias too so it needn't be one we've joined
+func prepareAliasBlock(ks *KeyStore, ledgerUUID string, blockType string, content string) (*BlockRequest, error) {
+
+	ks.mu.RLock()
+	aliasUUID, aliasKey := ks.PublicUUID, ks.PublicUserKey
+	ks.mu.RUnlock()
+
+	if aliasUUID == "" || aliasKey == nil {
+		return nil, ErrNoAlias
+	}
+
+	version := SignatureVersion
+
+	// an unknown ledger could be anyone's private one and the contents go out as they are
+	ledger, e := fetchLedgerAs(aliasClient, aliasUUID, aliasKey, "", ledgerUUID)
+	if e != nil {
+		return nil, e
+	}
+
+	if ledger.LedgerType != LEDGER_TYPE_PUBLIC {
+		return nil, ErrAliasLedger
+	}
+
+	date := time.Now().UTC().Format(time.RFC3339)
+	br := BlockRequest{Block: NewBlock{UUID: aliasUUID, Ledger: ledgerUUID, Date: date, Contents: base64.StdEncoding.EncodeToString([]byte(content)), BlockType: blockType}, SignatureVersion: version}
+
+	if version >= SIGNATURE_V3 {
+		br.ParentBlock = ledger.LastBlock
+	}
+
+	if e := signBlock(aliasKey, &br); e != nil {
+		return nil, e
+	}
+
+	return &br, nil
+}
@@ -0,0 +1,213 @@
+package thorne
+
+import (
+
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+)
+
+// ******************************************************
+// Attachments
+// Files are uploaded on their own to the signed URLs the API hands
+// back for a block, sealed as a stream under the ledger key and bound
+// to the ledger and the attachment's name
+// ******************************************************
+
+// a file to attach to a block, Content is read once to hash it and again to upload it
+type AttachmentFile struct {
+
+	Name 										string
+	ContentType 						string
+	Content 								io.ReadSeeker
+
+}
+
+// the metadata the block signs for this file
+func (f AttachmentFile) attachment() (Attachment, error) {
+
+	if _, e := f.Content.Seek(0, io.SeekStart); e != nil {
+		return Attachment{}, e
+	}
+
+	hash := sha256.New()
+	size, e := io.Copy(hash, f.Content)
+	if e != nil {
+		return Attachment{}, e
+	}
+
+	return Attachment{Name: f.Name, SHA256: hex.EncodeToString(hash.Sum(nil)), Size: int(size), ContentType: f.ContentType}, nil
+}
+
+func attachmentAssociatedData(ledgerUUID string, name string, epoch int) []byte {
+	return encodeFields([]byte("thorne/attachment"), []byte(ledgerUUID), []byte(name), binary.BigEndian.AppendUint32(nil, uint32(epoch)))
+}
+
+// upload content to uploadURL, size is the plaintext length or -1 when it isn't known
+func UploadAttachment(ks *KeyStore, ledgerUUID string, name string, uploadURL string, content io.Reader, size int64) error {
+
+	ledger, _ := GetLedger(ks, ledgerUUID)
+	if ledger == nil {
+		return ErrNotFound
+	}
+
+	length := size
+	body := content
+	if ledger.LedgerType != LEDGER_TYPE_PUBLIC && ledger.LedgerType != LEDGER_TYPE_REQUESTS {
+
+		key, ok := ks.LedgerKey(ledgerUUID)
+		if !ok {
+			return fmt.Errorf("No Ledger Key for UUID: %s", ledgerUUID)
+		}
+
+		pr, pw := io.Pipe()
+		defer pr.Close()
+
+		go func() {
+			pw.CloseWithError(sealAttachment(pw, key, ledgerUUID, name, content))
+		}()
+
+		body = pr
+		if size >= 0 {
+			length = int64(len(BLOCK_CIPHER_STREAM) + 4) + EncryptedStreamSize(size)
+		}
+	}
+
+	r, e := http.NewRequest("PUT", uploadURL, body)
+	if e != nil {
+		log.Printf("Failed to create request: %s", e)
+		return e
+	}
+
+	if length >= 0 {
+		r.ContentLength = length
+	}
+
+	c := &http.Client{}
+	x, e := c.Do(r)
+	if e != nil {
+		log.Printf("Upload Attachment Failed: %s", e)
+		return e
+	}
+	defer x.Body.Close()
+
+	if x.StatusCode != 200 {
+		return fmt.Errorf("Failed to upload attachment: %d", x.StatusCode)
+	}
+
+	return nil
+}
+
+// download an attachment into w, if this fails whatever was written to w must be discarded
+func DownloadAttachment(ks *KeyStore, ledgerUUID string, name string, downloadURL string, w io.Writer) error {
+
+	ledger, _ := GetLedger(ks, ledgerUUID)
+	if ledger == nil {
+		return ErrNotFound
+	}
+
+	x, e := http.Get(downloadURL)
+	if e != nil {
+		log.Printf("Failed to Fetch Attachment: %s", e)
+		return e
+	}
+	defer x.Body.Close()
+
+	if x.StatusCode != 200 {
+		return fmt.Errorf("Failed to fetch attachment: %d", x.StatusCode)
+	}
+
+	var body io.Reader = x.Body
+	if ledger.LedgerType != LEDGER_TYPE_PUBLIC && ledger.LedgerType != LEDGER_TYPE_REQUESTS {
+
+		key, ok := ks.LedgerKey(ledgerUUID)
+		if !ok {
+			return fmt.Errorf("No Ledger Key for UUID: %s", ledgerUUID)
+		}
+
+		if body, e = openAttachment(x.Body, key, ledgerUUID, name); e != nil {
+			log.Printf("Failed to Open Attachment: %s", e)
+			return e
+		}
+	}
+
+	if _, e := io.Copy(w, body); e != nil {
+		log.Printf("Failed to read Attachment: %s", e)
+		return e
+	}
+
+	return nil
+}
+
+// download an attachment of a verified block and check it against the hash and size the author signed
+func DownloadBlockAttachment(ks *KeyStore, br *BlockRequest, attachment Attachment, downloadURL string, w io.Writer) error {
+
+	if br.SignatureVersion < SIGNATURE_V3 {
+		return fmt.Errorf("Block from %s doesn't sign its attachments", br.Block.UUID)
+	}
+
+	if downloadURL == "" {
+		downloadURL = attachment.URL
+	}
+
+	hash := sha256.New()
+	counter := &countWriter{}
+	if e := DownloadAttachment(ks, br.Block.Ledger, attachment.Name, downloadURL, io.MultiWriter(w, hash, counter)); e != nil {
+		return e
+	}
+
+	if counter.n != int64(attachment.Size) || hex.EncodeToString(hash.Sum(nil)) != attachment.SHA256 {
+		return fmt.Errorf("Attachment %s doesn't match the block it belongs to", attachment.Name)
+	}
+
+	return nil
+}
+
+type countWriter struct {
+
+	n 											int64
+
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+func sealAttachment(w io.Writer, key SharedKey, ledgerUUID string, name string, content io.Reader) error {
+
+	if _, e := w.Write(binary.BigEndian.AppendUint32([]byte(BLOCK_CIPHER_STREAM), uint32(key.Epoch))); e != nil {
+		return e
+	}
+
+	sw, e := NewEncryptWriter(w, key.SharedSecret, attachmentAssociatedData(ledgerUUID, name, key.Epoch))
+	if e != nil {
+		return e
+	}
+
+	if _, e := io.Copy(sw, content); e != nil {
+		return e
+	}
+
+	return sw.Close()
+}
+
+func openAttachment(r io.Reader, key SharedKey, ledgerUUID string, name string) (io.Reader, error) {
+
+	epoch, e := readStreamEpoch(r)
+	if e != nil {
+		return nil, e
+	}
+
+	secret, ok := key.Secret(epoch)
+	if !ok {
+		return nil, ErrUnknownEpoch
+	}
+
+	return NewDecryptReader(r, secret, attachmentAssociatedData(ledgerUUID, name, epoch))
+}
@@ -0,0 +1,203 @@
+package thorne
+
+import (
+
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+
+)
+
+// ******************************************************
+// Block Encryption
+// Seals block bodies so they only open for the ledger, author,
+// type and date they were written with
+// ******************************************************
+
+// marks a body sealed by SealBlock, legacy bodies start straight with the nonce
+const BLOCK_CIPHER_V2 = "\x00TB2"
+
+// like BLOCK_CIPHER_V2 but followed by the key epoch, used once a ledger key has been rotated
+const BLOCK_CIPHER_EPOCH = "\x00TB3"
+
+// followed by the key epoch and a stream from NewEncryptWriter, for bodies too big to hold in memory
+const BLOCK_CIPHER_STREAM = "\x00TB4"
+
+// legacy bodies aren't bound to anything, turn this off once every writer has upgraded
+var AllowLegacyBlockCipher = true
+
+// random 96 bit nonces are only safe for 2^32 messages per key, stop well short of that
+// since other writers to the ledger may have sealed blocks we haven't seen yet
+var KeyUseLimit uint64 		= 1 << 31
+
+// past this the ledger asks for a new epoch after every write
+var KeyUseWarning uint64 	= KeyUseLimit / 4 * 3
+
+var ErrLegacyBlockCipher 	= errors.New("Legacy Block Encryption is not Allowed")
+var ErrUnknownEpoch 			= errors.New("No Ledger Key for Epoch")
+var ErrKeyExhausted 			= errors.New("Ledger Key has sealed too many Blocks, rotate it first")
+
+func blockAssociatedData(ledgerUUID string, author string, blockType string, date string, epoch int) []byte {
+
+	fields := [][]byte{[]byte("thorne/block/v2"), []byte(ledgerUUID), []byte(author), []byte(blockType), []byte(date)}
+	if epoch > 0 {
+		fields = append(fields, binary.BigEndian.AppendUint32(nil, uint32(epoch)))
+	}
+
+	return encodeFields(fields...)
+}
+
+func SealBlock(key []byte, epoch int, ledgerUUID string, author string, blockType string, date string, plaintext []byte) ([]byte, error) {
+
+	cipher, nonce, e := CryptWithData(key, plaintext, blockAssociatedData(ledgerUUID, author, blockType, date, epoch))
+	if e != nil {
+		log.Printf("Failed to Seal Block: %s", e)
+		return nil, e
+	}
+
+	// epoch 0 stays in the older format so peers that can't rotate keys can still read it
+	body := []byte(BLOCK_CIPHER_V2)
+	if epoch > 0 {
+		body = binary.BigEndian.AppendUint32([]byte(BLOCK_CIPHER_EPOCH), uint32(epoch))
+	}
+	body = append(body, nonce...)
+	body = append(body, cipher...)
+
+	return body, nil
+}
+
+// open a body read from ledgerUUID with whichever epoch of the key it was sealed under,
+// falling back to the legacy format when allowed
+func OpenBlock(key SharedKey, ledgerUUID string, block *NewBlock, body []byte) ([]byte, error) {
+
+	if bytes.HasPrefix(body, []byte(BLOCK_CIPHER_EPOCH)) && len(body) > len(BLOCK_CIPHER_EPOCH) + 4 {
+		epoch := int(binary.BigEndian.Uint32(body[len(BLOCK_CIPHER_EPOCH):]))
+		secret, ok := key.Secret(epoch)
+		if !ok {
+			return nil, ErrUnknownEpoch
+		}
+
+		return DecryptWithData(secret, body[len(BLOCK_CIPHER_EPOCH) + 4:], blockAssociatedData(ledgerUUID, block.UUID, block.BlockType, block.Date, epoch))
+	}
+
+	if bytes.HasPrefix(body, []byte(BLOCK_CIPHER_STREAM)) {
+		r, e := OpenBlockStream(bytes.NewReader(body), key, ledgerUUID, block)
+		if e != nil {
+			return nil, e
+		}
+
+		return io.ReadAll(r)
+	}
+
+	secret, ok := key.Secret(0)
+	if !ok {
+		return nil, ErrUnknownEpoch
+	}
+
+	if bytes.HasPrefix(body, []byte(BLOCK_CIPHER_V2)) {
+		b, e := DecryptWithData(secret, body[len(BLOCK_CIPHER_V2):], blockAssociatedData(ledgerUUID, block.UUID, block.BlockType, block.Date, 0))
+		if e == nil || !AllowLegacyBlockCipher {
+			return b, e
+		}
+
+		// a legacy nonce can start with the marker by chance
+	}
+
+	if !AllowLegacyBlockCipher {
+		return nil, ErrLegacyBlockCipher
+	}
+
+	return Decrypt(secret, body)
+}
+
+// start a streamed body on w, Close finishes the stream but leaves w open
+func SealBlockStream(w io.Writer, key []byte, epoch int, ledgerUUID string, author string, blockType string, date string) (io.WriteCloser, error) {
+
+	if _, e := w.Write(binary.BigEndian.AppendUint32([]byte(BLOCK_CIPHER_STREAM), uint32(epoch))); e != nil {
+		return nil, e
+	}
+
+	return NewEncryptWriter(w, key, blockAssociatedData(ledgerUUID, author, blockType, date, epoch))
+}
+
+// read a body written by SealBlockStream with whichever epoch it was sealed under
+func OpenBlockStream(r io.Reader, key SharedKey, ledgerUUID string, block *NewBlock) (io.Reader, error) {
+
+	epoch, e := readStreamEpoch(r)
+	if e != nil {
+		return nil, e
+	}
+
+	secret, ok := key.Secret(epoch)
+	if !ok {
+		return nil, ErrUnknownEpoch
+	}
+
+	return NewDecryptReader(r, secret, blockAssociatedData(ledgerUUID, block.UUID, block.BlockType, block.Date, epoch))
+}
+
+func readStreamEpoch(r io.Reader) (int, error) {
+
+	prefix := make([]byte, len(BLOCK_CIPHER_STREAM) + 4)
+	if _, e := io.ReadFull(r, prefix); e != nil {
+		return 0, ErrStreamTruncated
+	}
+
+	if string(prefix[:len(BLOCK_CIPHER_STREAM)]) != BLOCK_CIPHER_STREAM {
+		return 0, ErrStreamCorrupt
+	}
+
+	return int(binary.BigEndian.Uint32(prefix[len(BLOCK_CIPHER_STREAM):])), nil
+}
+
+// the epoch a body was sealed under, legacy and v2 bodies are always epoch 0
+func blockEpoch(body []byte) int {
+
+	if bytes.HasPrefix(body, []byte(BLOCK_CIPHER_EPOCH)) && len(body) > len(BLOCK_CIPHER_EPOCH) + 4 {
+		return int(binary.BigEndian.Uint32(body[len(BLOCK_CIPHER_EPOCH):]))
+	}
+
+	// streams derive their key from the ledger key so they count against its epoch too
+	if bytes.HasPrefix(body, []byte(BLOCK_CIPHER_STREAM)) {
+		epoch, e := readStreamEpoch(bytes.NewReader(body))
+		if e != nil {
+			return -1
+		}
+		return epoch
+	}
+
+	return 0
+}
+
+// count a block we're about to seal and hand back the key to seal it with, refusing
+// once the epoch is used up unless force is set for the rotation that replaces it
+func reserveKeyUse(ks *KeyStore, ledgerUUID string, force bool) (SharedKey, error) {
+
+	var reserved SharedKey
+	e := ks.UpdateLedgerKey(ledgerUUID, func(key *SharedKey) error {
+
+		if key.Uses >= KeyUseLimit && !force {
+			log.Printf("Ledger %s has sealed %d blocks under epoch %d", ledgerUUID, key.Uses, key.Epoch)
+			return ErrKeyExhausted
+		}
+
+		key.Uses++
+		reserved = *key
+		return nil
+	})
+
+	return reserved, e
+}
+
+// count a block someone else sealed with our current epoch
+func countKeyUse(ks *KeyStore, ledgerUUID string, epoch int) {
+
+	ks.UpdateLedgerKey(ledgerUUID, func(key *SharedKey) error {
+		if epoch == key.Epoch {
+			key.Uses++
+		}
+		return nil
+	})
+}
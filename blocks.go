@@ -2,12 +2,20 @@ package thorne
 
 import (
 
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/mlkem"
+	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"time"
 
 )
 
@@ -15,12 +23,43 @@ import (
 // Key Exchange
 // Allow devices can negotiate a mutual 32bit key
 // ******************************************************
+
+// versions of the key exchange, peers from before the Version field send 0
+const (
+
+	KE_VERSION_PKCS1 		= iota 				// UUID and message wrapped with rsa PKCS#1 v1.5
+	KE_VERSION_OAEP 										// UUID and message wrapped with rsa OAEP (sha256)
+	KE_VERSION_HYBRID 									// intro message sealed with a wrapped aes key so it can be any length
+	KE_VERSION_SIGNED 									// ephemeral keys signed by each side's identity key
+	KE_VERSION_HKDF 										// exchanged salts and both UUIDs bound into the key derivation
+	KE_VERSION_PQ 											// ML-KEM-768 encapsulation mixed in with the ECDH secret
+
+)
+
+// the version used for new requests, lower it to reach peers that haven't upgraded yet.
+// KE_VERSION_PQ is opt in here, requests that offer it are always answered with it
+var KeyExchangeVersion = KE_VERSION_HKDF
+
+// the oldest version accepted from a peer, every supported version by default so peers that
+// haven't upgraded can still connect. anything below KE_VERSION_SIGNED can be rewritten in
+// transit so raise this to KE_VERSION_SIGNED or later once they have
+var MinKeyExchangeVersion = KE_VERSION_PKCS1
+
+var ErrKeyExchangeVersion = errors.New("Unsupported Key Exchange Version")
+var ErrKeyExchangeSignature = errors.New("Key Exchange Signature is Invalid")
+
 const KeyExchangeInitType = "ke0"
 type KeyExchangeInit struct {
 
+	Version 						int 					// KE_VERSION_* of the initiator
 	EphemerealPublicKey string  			// public key of the initiator
 	UUID 								string 				// UUID of the initiator
 	Message 						string 				// Intro Message
+	Intro 							*SealedPayload 		// Intro Message from KE_VERSION_HYBRID on
+	KeySignature 				string 				// initiator's identity or device signature over the ephemeral key and both UUIDs
+	Device 							string 				// DeviceID when a device made KeySignature
+	Salt 								string 				// initiator's half of the key derivation salt
+	KEMPublicKey 				string 				// initiator's ML-KEM-768 encapsulation key from KE_VERSION_PQ on
 
 }
 
@@ -36,31 +75,69 @@ func DoKeyExchangeInit(ks *KeyStore, uuid string, message string) error {
 		return e
 	}
 
+	if e := checkRSARevocation(uuid, pubKey); e != nil {
+		return e
+	}
+
 	// create a new key to negotiate the shared key
 	priv := GenerateKey()
-	
+	salt := []byte{}
+	if KeyExchangeVersion >= KE_VERSION_HKDF {
+		salt = GeneratePass()
+	}
+
+	// the responder encapsulates a second secret to this so recorded traffic needs more than ECDH broken
+	kemKey := []byte{}
+	var kemPriv *mlkem.DecapsulationKey768
+	if KeyExchangeVersion >= KE_VERSION_PQ {
+		if kemPriv, e = mlkem.GenerateKey768(); e != nil {
+			log.Printf("Failed to Generate ML-KEM Key: %s", e)
+			return e
+		}
+		kemKey = kemPriv.EncapsulationKey().Bytes()
+	}
+
 	// setup our pending connections struct
-	ks.PendingConnections[uuid] = SharedKey{Status: 0, EphemeralPrivateKey: MarshalPrivateKey(priv)}
+	pending := SharedKey{Status: 0, EphemeralPrivateKey: MarshalPrivateKey(priv), Version: KeyExchangeVersion, Salt: salt, PeerRSAKey: encodeRSAPublicKey(pubKey)}
+	if kemPriv != nil {
+		pending.KEMPrivateKey = kemPriv.Bytes()
+	}
+	ks.SetPendingConnection(uuid, pending)
 
 	// marshal the public key to send
 	bKey := elliptic.Marshal(elliptic.P521(), priv.PublicKey.X, priv.PublicKey.Y)
 
 	// use the rsa key for the other user to encrypt our uuid
-	cipherUUID, e := rsaEncypt(pubKey, ks.UUID)
+	cipherUUID, e := keyExchangeEncrypt(KeyExchangeVersion, pubKey, ks.UUID)
 	if e != nil {
 		log.Printf("failed to encrypt uuid: %s", e)
 		return e
 	}
 
+	// setup our response
+	ker := KeyExchangeInit{Version: KeyExchangeVersion, EphemerealPublicKey: base64.StdEncoding.EncodeToString(bKey), UUID: cipherUUID, Salt: base64.StdEncoding.EncodeToString(salt)}
+	if len(kemKey) > 0 {
+		ker.KEMPublicKey = base64.StdEncoding.EncodeToString(kemKey)
+	}
+
+	// vouch for the ephemeral keys with our identity so they can't be swapped in transit
+	if KeyExchangeVersion >= KE_VERSION_SIGNED {
+		if ker.KeySignature, ker.Device, e = signKeyExchange(ks, KeyExchangeVersion, KeyExchangeInitType, bKey, uuid, salt, kemKey); e != nil {
+			return e
+		}
+	}
+
 	// use their rsa key to encrypt our hello message
-	cipherMsg, e := rsaEncypt(pubKey, message)
+	if KeyExchangeVersion >= KE_VERSION_HYBRID {
+		ker.Intro, e = SealPayload(pubKey, []byte(message))
+	} else {
+		ker.Message, e = keyExchangeEncrypt(KeyExchangeVersion, pubKey, message)
+	}
+
 	if e != nil {
-		log.Printf("failed to encrypt uuid: %s", e)
+		log.Printf("failed to encrypt message: %s", e)
 		return e
 	}
-
-	// setup our response
-	ker := KeyExchangeInit{EphemerealPublicKey: base64.StdEncoding.EncodeToString(bKey), UUID: cipherUUID, Message: cipherMsg}
 	buf, e := json.Marshal(ker)
 	if e != nil {
 		log.Printf("Failed to Marshal KeyExchangeInit: %s", e)
@@ -72,6 +149,87 @@ func DoKeyExchangeInit(ks *KeyStore, uuid string, message string) error {
 	return WriteBlock(ks, "ul" + uuid, KeyExchangeInitType, string(buf))
 }
 
+// wrap a handshake field for the peer's rsa key using the scheme for version
+func keyExchangeEncrypt(version int, key *rsa.PublicKey, plaintext string) (string, error) {
+
+	if version >= KE_VERSION_OAEP {
+		return rsaEncryptOAEP(key, plaintext)
+	}
+
+	return rsaEncypt(key, plaintext)
+}
+
+func keyExchangeDecrypt(version int, key crypto.Decrypter, cipherString string) (string, error) {
+
+	if version >= KE_VERSION_OAEP {
+		return rsaDecryptOAEP(key, cipherString)
+	}
+
+	return rsaDecrypt(key, cipherString)
+}
+
+// what each side signs to bind the version and its ephemeral key (and salt from KE_VERSION_HKDF,
+// kem key or ciphertext from KE_VERSION_PQ) to both parties, and the device when one signed
+func keyExchangeSigningPayload(version int, blockType string, ephemeralKey []byte, from string, to string, salt []byte, kem []byte, device string) []byte {
+
+	fields := [][]byte{[]byte("thorne/" + blockType), []byte(strconv.Itoa(version)), ephemeralKey, []byte(from), []byte(to)}
+	if len(salt) > 0 {
+		fields = append(fields, salt)
+	}
+
+	if len(kem) > 0 {
+		fields = append(fields, kem)
+	}
+
+	return encodeFields(withDevice(device, fields...)...)
+}
+
+// sign our ephemeral key with the device key if we have one so a device never needs the identity key
+func signKeyExchange(ks *KeyStore, version int, blockType string, ephemeralKey []byte, to string, salt []byte, kem []byte) (string, string, error) {
+
+	signer, device := ks.BlockSigner(), ks.SigningDevice()
+	if signer == nil {
+		return "", "", ErrNoIdentityKey
+	}
+
+	signature, e := GenerateSignature(signer, keyExchangeSigningPayload(version, blockType, ephemeralKey, ks.UUID, to, salt, kem, device))
+	if e != nil {
+		return "", "", e
+	}
+
+	return base64.StdEncoding.EncodeToString(signature), device, nil
+}
+
+// check a peer's signature over its ephemeral key, unsigned keys are only allowed from versions before signing.
+// the identity key that vouched for it, directly or thru a device, is returned to be pinned
+func verifyKeyExchangeSignature(version int, blockType string, signature string, ephemeralKey []byte, from string, to string, salt []byte, kem []byte, device string) (*ecdsa.PublicKey, error) {
+
+	if version < KE_VERSION_SIGNED {
+		return nil, nil
+	}
+
+	// handshakes happen now so the key has to be good now
+	now := time.Now()
+	key := GetPublicKey(from)
+	identity := key
+	if device != "" {
+		var e error
+		if key, identity, e = deviceKeyAt(from, device, now.UTC().Format(time.RFC3339), now); e != nil {
+			log.Printf("No Device Key for %s %s: %s", from, device, e)
+			return nil, e
+		}
+	} else if e := checkIdentityRevocation(from, key, now.UTC().Format(time.RFC3339), now); e != nil {
+		return nil, e
+	}
+
+	if len(signature) == 0 || !VerifySignature(key, signature, keyExchangeSigningPayload(version, blockType, ephemeralKey, from, to, salt, kem, device)) {
+		log.Printf("Failed to verify %s key signature from %s", blockType, from)
+		return nil, ErrKeyExchangeSignature
+	}
+
+	return identity, nil
+}
+
 func UnmarshalKeyExchangeInit(buf []byte) (*KeyExchangeInit, error) {
 	kei := &KeyExchangeInit{}
 	e := json.Unmarshal(buf, kei)
@@ -83,6 +241,17 @@ func HandleKeyExchangeInit(ks *KeyStore, ke *KeyExchangeInit) error {
 
 	log.Printf("HandleKeyExchangeInit: %s %#v", ke.UUID, ke)
 
+	if ke.Version < MinKeyExchangeVersion {
+		log.Printf("HandleKeyExchangeInit: Refusing Version %d", ke.Version)
+		return ErrKeyExchangeVersion
+	}
+
+	// answer with the version offered, a signed offer won't take anything lower
+	version := ke.Version
+	if version > KE_VERSION_PQ {
+		version = KE_VERSION_PQ
+	}
+
 	// create a new key to  negotiate the shared key
 	priv := GenerateKey()
 	
@@ -94,25 +263,54 @@ func HandleKeyExchangeInit(ks *KeyStore, ke *KeyExchangeInit) error {
 	}
 
 	// use our rsa key to decrypt their uuid and the message
-	ke.UUID, e = rsaDecrypt(ks.RSAKey, ke.UUID)
+	ke.UUID, e = keyExchangeDecrypt(ke.Version, ks.RSADecrypter(), ke.UUID)
 	if e != nil {
 		log.Printf("HandleKeyExchangeInit: Failed to RSA Decrypt UUID (%s) %s", ke.UUID, e)
 		return e
 	}
 
-	ke.Message, e = rsaDecrypt(ks.RSAKey, ke.Message)
+	if ke.Version >= KE_VERSION_HYBRID {
+		if ke.Intro == nil {
+			return fmt.Errorf("HandleKeyExchangeInit: Missing Intro")
+		}
+
+		var b []byte
+		b, e = OpenPayload(ks, ke.Intro)
+		ke.Message = string(b)
+	} else {
+		ke.Message, e = keyExchangeDecrypt(ke.Version, ks.RSADecrypter(), ke.Message)
+	}
+
 	if e != nil {
 		log.Printf("HandleKeyExchangeInit: Failed to RSA Decrypt Message (%s) %s", ke.Message, e)
 		return e
 	}
 
-	ks.PendingConnections[ke.UUID] = SharedKey{Status: 1, PublicKey: pubKey, EphemeralPrivateKey: MarshalPrivateKey(priv), Message: ke.Message }
+	initiatorSalt, e := base64.StdEncoding.DecodeString(ke.Salt)
+	if e != nil {
+		log.Printf("HandleKeyExchangeInit: Failed to Decode Salt (%s) %s", ke.Salt, e)
+		return e
+	}
+
+	if ke.Version >= KE_VERSION_HKDF && len(initiatorSalt) == 0 {
+		return fmt.Errorf("HandleKeyExchangeInit: Missing Salt")
+	}
 
-	log.Printf("Received Connection Request from %s with message: %s", ke.UUID, ke.Message)
+	kemKey, e := base64.StdEncoding.DecodeString(ke.KEMPublicKey)
+	if e != nil {
+		log.Printf("HandleKeyExchangeInit: Failed to Decode KEMPublicKey: %s", e)
+		return e
+	}
 
-	// marshal the public key to send
-	bKey := elliptic.Marshal(elliptic.P521(), priv.PublicKey.X, priv.PublicKey.Y)
+	if ke.Version >= KE_VERSION_PQ && len(kemKey) == 0 {
+		return fmt.Errorf("HandleKeyExchangeInit: Missing KEM Public Key")
+	}
 
+	// make sure the keys really came from the initiator before we agree to anything
+	identity, e := verifyKeyExchangeSignature(ke.Version, KeyExchangeInitType, ke.KeySignature, pubKey, ke.UUID, ks.UUID, initiatorSalt, kemKey, ke.Device)
+	if e != nil {
+		return e
+	}
 
 	// grab the rsa key for this user
 	rsapubKey, e := RsaGetPublicKey(ke.UUID)
@@ -121,14 +319,57 @@ func HandleKeyExchangeInit(ks *KeyStore, ke *KeyExchangeInit) error {
 		return e
 	}
 
-	cipherUUID, e := rsaEncypt(rsapubKey, ks.UUID)
+	if e := checkRSARevocation(ke.UUID, rsapubKey); e != nil {
+		return e
+	}
+
+	// the final salt is both halves so neither side picks it alone
+	salt := []byte{}
+	if version >= KE_VERSION_HKDF {
+		salt = GeneratePass()
+	}
+
+	pending := SharedKey{Status: 1, PublicKey: pubKey, EphemeralPrivateKey: MarshalPrivateKey(priv), Message: ke.Message, Version: version, Verified: identity != nil, Salt: append(initiatorSalt, salt...), PeerRSAKey: encodeRSAPublicKey(rsapubKey) }
+	if identity != nil {
+		pending.PeerIdentityKey = encodePublicKey(identity)
+	}
+
+	// encapsulate a secret to the initiator's kem key, only they can get it back out of the ciphertext
+	kemCiphertext := []byte{}
+	if version >= KE_VERSION_PQ {
+		ek, e := mlkem.NewEncapsulationKey768(kemKey)
+		if e != nil {
+			log.Printf("HandleKeyExchangeInit: Invalid KEM Public Key: %s", e)
+			return e
+		}
+		pending.KEMSecret, kemCiphertext = ek.Encapsulate()
+	}
+
+	ks.SetPendingConnection(ke.UUID, pending)
+
+	log.Printf("Received Connection Request from %s with message: %s", ke.UUID, ke.Message)
+
+	// marshal the public key to send
+	bKey := elliptic.Marshal(elliptic.P521(), priv.PublicKey.X, priv.PublicKey.Y)
+
+
+	cipherUUID, e := keyExchangeEncrypt(version, rsapubKey, ks.UUID)
 	if e != nil {
 		log.Printf("failed to encrypt uuid: %s", e)
 		return e
 	}
 
 	// setup our response
-	ker := KeyExchangeResponse{EphemerealPublicKey: base64.StdEncoding.EncodeToString(bKey), UUID: cipherUUID}
+	ker := KeyExchangeResponse{Version: version, EphemerealPublicKey: base64.StdEncoding.EncodeToString(bKey), UUID: cipherUUID, Salt: base64.StdEncoding.EncodeToString(salt)}
+	if len(kemCiphertext) > 0 {
+		ker.KEMCiphertext = base64.StdEncoding.EncodeToString(kemCiphertext)
+	}
+
+	if version >= KE_VERSION_SIGNED {
+		if ker.KeySignature, ker.Device, e = signKeyExchange(ks, version, KeyExchangeResponseType, bKey, ke.UUID, salt, kemCiphertext); e != nil {
+			return e
+		}
+	}
 
 	buf, e := json.Marshal(ker)
 	if e != nil {
@@ -142,9 +383,13 @@ func HandleKeyExchangeInit(ks *KeyStore, ke *KeyExchangeInit) error {
 const KeyExchangeResponseType = "ke1"
 type KeyExchangeResponse struct {
 
+	Version 						int 					// KE_VERSION_* chosen by the responder
 	EphemerealPublicKey string 				// public key of the responder
 	UUID 								string 				// UUID of the responder
-	//Salt 								string 				// salt for entropy
+	KeySignature 				string 				// responder's identity or device signature over the ephemeral key and both UUIDs
+	Device 							string 				// DeviceID when a device made KeySignature
+	Salt 								string 				// responder's half of the key derivation salt
+	KEMCiphertext 			string 				// ML-KEM-768 encapsulation to the initiator's KEMPublicKey from KE_VERSION_PQ on
 
 }
 
@@ -159,8 +404,13 @@ func HandleKeyExchangeResponse(ks *KeyStore, ke *KeyExchangeResponse) error {
 
 	var e error
 
+	if ke.Version < MinKeyExchangeVersion || ke.Version > KeyExchangeVersion {
+		log.Printf("HandleKeyExchangeResponse: Refusing Version %d", ke.Version)
+		return ErrKeyExchangeVersion
+	}
+
 	// use our rsa key to decrypt their uuid and the message
-	ke.UUID, e = rsaDecrypt(ks.RSAKey, ke.UUID)
+	ke.UUID, e = keyExchangeDecrypt(ke.Version, ks.RSADecrypter(), ke.UUID)
 	if e != nil {
 		log.Printf("HandleKeyExchangeInit: Failed to RSA Decrypt UUID (%s) %s", ke.UUID, e)
 		return e
@@ -178,16 +428,70 @@ func HandleKeyExchangeResponse(ks *KeyStore, ke *KeyExchangeResponse) error {
 	pubKey, e := base64.StdEncoding.DecodeString(ke.EphemerealPublicKey)
 	if e != nil {
 		log.Printf("Failed to decode public key: %s", e)
+		return e
 	}
-	x, y := elliptic.Unmarshal(elliptic.P521(), pubKey)
-  bKey := &ecdsa.PublicKey{elliptic.P521(), x, y}
-	
+
+	responderSalt, e := base64.StdEncoding.DecodeString(ke.Salt)
+	if e != nil {
+		log.Printf("Failed to decode salt: %s", e)
+		return e
+	}
+
+	kemCiphertext, e := base64.StdEncoding.DecodeString(ke.KEMCiphertext)
+	if e != nil {
+		log.Printf("Failed to decode kem ciphertext: %s", e)
+		return e
+	}
+
 	// grab the previous key negotiation information
-	priv := UnmarshalPrivateKey(ks.PendingConnections[ke.UUID].EphemeralPrivateKey)
+	pending, ok := ks.PendingConnection(ke.UUID)
+	if !ok {
+		return fmt.Errorf("No Pending Connection for %s", ke.UUID)
+	}
 
-	log.Printf("Priv %#v Pub %#v", priv, bKey)
+	// the responder can only pick a version at or below the one we asked for, and once we've
+	// signed our offer only that version, or the response could be relabelled to drop the signatures
+	if ke.Version > pending.Version || (pending.Version >= KE_VERSION_SIGNED && ke.Version != pending.Version) {
+		log.Printf("HandleKeyExchangeResponse: Version %d doesn't match requested %d", ke.Version, pending.Version)
+		return ErrKeyExchangeVersion
+	}
+
+	// an answer without the kem secret would leave recorded traffic to ECDH alone
+	if len(pending.KEMPrivateKey) > 0 && ke.Version < KE_VERSION_PQ {
+		log.Printf("HandleKeyExchangeResponse: Refusing Version %d to a post quantum request", ke.Version)
+		return ErrKeyExchangeVersion
+	}
+
+	identity, e := verifyKeyExchangeSignature(ke.Version, KeyExchangeResponseType, ke.KeySignature, pubKey, ke.UUID, ks.UUID, responderSalt, kemCiphertext, ke.Device)
+	if e != nil {
+		return e
+	}
+
+	x, y := elliptic.Unmarshal(elliptic.P521(), pubKey)
+  bKey := &ecdsa.PublicKey{elliptic.P521(), x, y}
+	priv := UnmarshalPrivateKey(pending.EphemeralPrivateKey)
+
+	var sKey, authKey []byte
+	if ke.Version >= KE_VERSION_HKDF {
+		if len(pending.Salt) == 0 || len(responderSalt) == 0 {
+			return fmt.Errorf("Missing Key Derivation Salt")
+		}
+
+		var kemSecret []byte
+		if ke.Version >= KE_VERSION_PQ {
+			if kemSecret, e = decapsulate(pending.KEMPrivateKey, kemCiphertext); e != nil {
+				log.Printf("Failed to Decapsulate KEM Secret: %s", e)
+				return e
+			}
+			defer wipe(kemSecret)
+		}
+
+		ctx := KeyContext{Version: ke.Version, Purpose: KDF_PURPOSE_CONNECTION, Initiator: ks.UUID, Responder: ke.UUID}
+		sKey, authKey, e = DeriveHybridKeys(priv, bKey, kemSecret, append(pending.Salt, responderSalt...), ctx)
+	} else {
+		sKey, e = GenerateSymetricKey(priv, bKey)
+	}
 
-	sKey, e := GenerateSymetricKey(priv, bKey)
 	if e != nil {
 		log.Printf("Failed to GenerateSymetricKey: %s", e)
 		return e
@@ -195,16 +499,26 @@ func HandleKeyExchangeResponse(ks *KeyStore, ke *KeyExchangeResponse) error {
 
 	//log.Printf("Generated Symmetric Key %s", base64.StdEncoding.EncodeToString(sKey))
 
+	// pin the keys the exchange was made with before there's a ledger, keys that changed on a
+	// connection we already had stop it here
+	if e := recordConnection(ks, ke.UUID, identity, pending.PeerRSAKey); e != nil {
+		return e
+	}
+
 	ledgerUUID, e := CreateLedger(ks, "", "", "", false, LEDGER_TYPE_ONEONONE, sKey, []string{ke.UUID})
 	if e != nil {
 		log.Printf("Failed to Create Ledger: %s", e)
 		return e
 	}
+	setLedgerAuthKey(ks, ledgerUUID, authKey)
 
-	delete(ks.PendingConnections, ke.UUID)
+	ks.DeletePendingConnection(ke.UUID)
 
 	// setup our response ack
 	ker := KeyExchangeAck{UUID: ks.UUID, LedgerUUID: ledgerUUID, Test: "All Set"}
+	if authKey != nil {
+		ker.Confirmation = keyConfirmation(authKey, ledgerUUID, ks.UUID, ke.UUID)
+	}
 	buf, e := json.Marshal(ker)
 	if e != nil {
 		log.Printf("Failed to Marshal KeyExchangeResponse: %s", e)
@@ -229,6 +543,7 @@ type KeyExchangeAck struct {
 	UUID 								string 				// UUID of the initiator
 	Test 								string 				// encrypted message to Test results
 	LedgerUUID 					string
+	Confirmation 				string 				// hmac with the authentication key from KE_VERSION_HKDF on
 
 }
 
@@ -238,93 +553,157 @@ func UnmarshalKeyExchangeAck(buf []byte) (*KeyExchangeAck, error) {
 	return kei, e
 }
 
-// connection request ack received so handle it
-func HandleKeyExchangeAck(ks *KeyStore, ke *KeyExchangeAck) error {
+// the ack is sealed with the new connection key so the block's author is used to find the pending connection
+func OpenKeyExchangeAck(ks *KeyStore, author string, body []byte) (*KeyExchangeAck, error) {
 
-	log.Printf("HandleKeyExchangeAck: %s", ke.UUID)
+	sKey, authKey, e := pendingConnectionKey(ks, author)
+	if e != nil {
+		return nil, e
+	}
 
-	// create a new key to  negotiate the shared key
-	x, y := elliptic.Unmarshal(elliptic.P521(), ks.PendingConnections[ke.UUID].PublicKey)
-  bKey := &ecdsa.PublicKey{elliptic.P521(), x, y}
-	
-	// grab the previous key negotiation information
-	priv := UnmarshalPrivateKey(ks.PendingConnections[ke.UUID].EphemeralPrivateKey)
+	b, e := Decrypt(sKey, body)
+	if e != nil {
+		log.Printf("Failed to Decrypt KeyExchangeAck from %s: %s", author, e)
+		return nil, e
+	}
 
-	sKey, e := GenerateSymetricKey(priv, bKey)
+	ack, e := UnmarshalKeyExchangeAck(b)
 	if e != nil {
-		log.Printf("Failed to GenerateSymetricKey: %s", e)
-		return e
+		return nil, e
 	}
 
-	// save a ledger that was given to us
-	SaveLedger(ks, ke.LedgerUUID, LEDGER_TYPE_ONEONONE, sKey, []string{ke.UUID})
-	delete(ks.PendingConnections, ke.UUID)
-	return nil
+	if ack.UUID != author {
+		return nil, fmt.Errorf("KeyExchangeAck from %s claims to be %s", author, ack.UUID)
+	}
+
+	// both sides must have derived the same authentication key
+	if authKey != nil && !hmac.Equal([]byte(ack.Confirmation), []byte(keyConfirmation(authKey, ack.LedgerUUID, author, ks.UUID))) {
+		return nil, fmt.Errorf("KeyExchangeAck from %s failed key confirmation", author)
+	}
+
+	return ack, nil
 }
 
-const KeyRotationType = "kr"
-type KeyRotation struct {
+// recover the secret the responder encapsulated to our kem key
+func decapsulate(seed []byte, ciphertext []byte) ([]byte, error) {
 
-	UUID 								string 				// UUID of the initiator
-	Test 								string 				// encrypted message to Test results
-	LedgerUUID 					string
-	PublicKey 					string
+	if len(ciphertext) == 0 {
+		return nil, fmt.Errorf("Missing KEM Ciphertext")
+	}
+
+	dk, e := mlkem.NewDecapsulationKey768(seed)
+	if e != nil {
+		return nil, e
+	}
 
+	return dk.Decapsulate(ciphertext)
 }
 
-func UnmarshalKeyRotation(buf []byte) (*KeyRotation, error) {
-	kei := &KeyRotation{}
-	e := json.Unmarshal(buf, kei)
-	return kei, e
+// proves possession of the authentication key for the new ledger
+func keyConfirmation(authKey []byte, ledgerUUID string, initiator string, responder string) string {
+
+	mac := hmac.New(sha256.New, authKey)
+	mac.Write(encodeFields([]byte("thorne/" + KeyExchangeAckType), []byte(ledgerUUID), []byte(initiator), []byte(responder)))
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
 }
 
-// connection requested key rotation so start it
-/*
-func StartKeyRotation(ks *KeyStore, ke *KeyRotation) error {
+func setLedgerAuthKey(ks *KeyStore, ledgerUUID string, authKey []byte) {
+
+	if authKey == nil {
+		return
+	}
+
+	key, _ := ks.LedgerKey(ledgerUUID)
+	key.AuthKey = authKey
+	ks.SetLedgerKey(ledgerUUID, key)
+}
+
+// derive the keys for a connection we responded to, refusing if the initiator's key wasn't authenticated
+// the authentication key is nil for versions before KE_VERSION_HKDF
+func pendingConnectionKey(ks *KeyStore, uuid string) ([]byte, []byte, error) {
+
+	pending, ok := ks.PendingConnection(uuid)
+	if !ok {
+		return nil, nil, fmt.Errorf("No Pending Connection for %s", uuid)
+	}
+
+	if pending.Version < MinKeyExchangeVersion {
+		return nil, nil, ErrKeyExchangeVersion
+	}
 
-	log.Printf("HandleKeyRotation: %s", ke.UUID)
+	if pending.Version >= KE_VERSION_SIGNED && !pending.Verified {
+		return nil, nil, ErrKeyExchangeSignature
+	}
 
 	// create a new key to  negotiate the shared key
-	x, y := elliptic.Unmarshal(elliptic.P521(), ks.PendingConnections[ke.UUID].PublicKey)
-  bKey := &ecdsa.PublicKey{elliptic.P521(), x, y}
-	
+	x, y := elliptic.Unmarshal(elliptic.P521(), pending.PublicKey)
+	if x == nil {
+		return nil, nil, fmt.Errorf("Invalid Ephemeral Key for %s", uuid)
+	}
+	bKey := &ecdsa.PublicKey{Curve: elliptic.P521(), X: x, Y: y}
+
 	// grab the previous key negotiation information
-	priv := UnmarshalPrivateKey(ks.PendingConnections[ke.UUID].EphemeralPrivateKey)
+	priv := UnmarshalPrivateKey(pending.EphemeralPrivateKey)
+
+	if pending.Version >= KE_VERSION_PQ && len(pending.KEMSecret) == 0 {
+		return nil, nil, fmt.Errorf("Missing KEM Secret for %s", uuid)
+	}
+
+	if pending.Version >= KE_VERSION_HKDF {
+		ctx := KeyContext{Version: pending.Version, Purpose: KDF_PURPOSE_CONNECTION, Initiator: uuid, Responder: ks.UUID}
+		return DeriveHybridKeys(priv, bKey, pending.KEMSecret, pending.Salt, ctx)
+	}
 
 	sKey, e := GenerateSymetricKey(priv, bKey)
 	if e != nil {
 		log.Printf("Failed to GenerateSymetricKey: %s", e)
-		return e
+		return nil, nil, e
 	}
 
-	// save a ledger that was given to us
-	delete(ks.PendingConnections, ke.UUID)
-	return nil
+	return sKey, nil, nil
 }
 
-// connection requested key rotation so start it
-func HandleKeyRotation(ks *KeyStore, ke *KeyRotation) error {
-
-	log.Printf("HandleKeyRotation: %s", ke.UUID)
+// connection request ack received so handle it
+func HandleKeyExchangeAck(ks *KeyStore, ke *KeyExchangeAck) error {
 
-	// create a new key to  negotiate the shared key
-	x, y := elliptic.Unmarshal(elliptic.P521(), ks.PendingConnections[ke.UUID].PublicKey)
-  bKey := &ecdsa.PublicKey{elliptic.P521(), x, y}
-	
-	// grab the previous key negotiation information
-	priv := UnmarshalPrivateKey(ks.PendingConnections[ke.UUID].EphemeralPrivateKey)
+	log.Printf("HandleKeyExchangeAck: %s", ke.UUID)
 
-	sKey, e := GenerateSymetricKey(priv, bKey)
+	sKey, authKey, e := pendingConnectionKey(ks, ke.UUID)
 	if e != nil {
-		log.Printf("Failed to GenerateSymetricKey: %s", e)
+		return e
+	}
+
+	pending, _ := ks.PendingConnection(ke.UUID)
+	if e := recordConnection(ks, ke.UUID, decodePublicKey(pending.PeerIdentityKey), pending.PeerRSAKey); e != nil {
 		return e
 	}
 
 	// save a ledger that was given to us
-	delete(ks.PendingConnections, ke.UUID)
+	SaveLedger(ks, ke.LedgerUUID, LEDGER_TYPE_ONEONONE, sKey, []string{ke.UUID})
+	setLedgerAuthKey(ks, ke.LedgerUUID, authKey)
+	ks.DeletePendingConnection(ke.UUID)
 	return nil
 }
-*/
+
+const KeyRotationType = "kr"
+type KeyRotation struct {
+
+	UUID 								string 				// UUID of the initiator
+	Test 								string 				// encrypted message to Test results
+	LedgerUUID 					string
+	PublicKey 					string 				// sender's ephemeral key for the new epoch
+	Epoch 							int 					// epoch being rotated to
+	Reply 							bool 					// answering a rotation the other side started
+
+}
+
+func UnmarshalKeyRotation(buf []byte) (*KeyRotation, error) {
+	kei := &KeyRotation{}
+	e := json.Unmarshal(buf, kei)
+	return kei, e
+}
+
 // ******************************************************
 // Social
 // Exchanging short messages
@@ -437,6 +816,13 @@ type NotificateNewLedger struct {
 	Key 								string
 	User 								[]string
 	LedgerType 					int
+	Epoch 							int 					// epoch of Key, circles move on when a member leaves
 
 }
 
+func UnmarshalNotificateNewLedger(buf []byte) (*NotificateNewLedger, error) {
+	kei := &NotificateNewLedger{}
+	e := json.Unmarshal(buf, kei)
+	return kei, e
+}
+
@@ -2,10 +2,12 @@ package thorne
 
 import (
 
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
@@ -27,19 +29,111 @@ func GenerateKey() *ecdsa.PrivateKey {
 	return k
 }
 
-func GenerateSignature(k *ecdsa.PrivateKey, data []byte) []byte {
+// k is usually an *ecdsa.PrivateKey but may be anything holding the identity key like an
+// AgentClient, which can fail when the agent is locked, refuses or has gone away
+func GenerateSignature(k crypto.Signer, data []byte) ([]byte, error) {
 
 	hash := sha256.Sum256(data)
-	signature, e := ecdsa.SignASN1(rand.Reader, k, hash[:])
+	return GenerateDigestSignature(k, hash[:])
+}
+
+// sign a SHA256 digest that was hashed as the data streamed past
+func GenerateDigestSignature(k crypto.Signer, digest []byte) ([]byte, error) {
+
+	signature, e := k.Sign(rand.Reader, digest, crypto.SHA256)
 	if e != nil {
-		log.Fatalf("Sign Failed: %s", e)
+		log.Printf("Sign Failed: %s", e)
+		return nil, e
 	}
 
-	return signature
+	return signature, nil
 }
 
+// the original unsalted derivation, still used by ledgers negotiated before KE_VERSION_HKDF
 func GenerateSymetricKey(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey) ([]byte, error) {
 
+	buf, e := generateShared(privateKey, publicKey)
+	if e != nil {
+		return nil, e
+	}
+	defer wipe(buf)
+
+  hash := sha256.New
+  kdf := hkdf.New(hash, buf, nil, nil)
+
+  k := make([]byte, 32)
+  if _, e := io.ReadFull(kdf, k); e != nil {
+      log.Printf("Failed to read from HKDF: %s", e)
+      return nil, e
+  }
+
+  return k, nil
+}
+
+// what a derived key is for and who it is between, fed to HKDF as the info
+type KeyContext struct {
+
+	Version 								int 						// KE_VERSION_* of the handshake
+	Purpose 								string 					// KDF_PURPOSE_*
+	Initiator 							string 					// UUID of the side that started the exchange
+	Responder 							string 					// UUID of the side that answered
+
+}
+
+const KDF_PURPOSE_CONNECTION = "connection-ledger"
+
+// derive separate encryption and authentication keys bound to the salt and context
+func DeriveSymetricKeys(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey, salt []byte, ctx KeyContext) ([]byte, []byte, error) {
+
+	buf, e := generateShared(privateKey, publicKey)
+	if e != nil {
+		return nil, nil, e
+	}
+	defer wipe(buf)
+
+	return deriveKeys(buf, salt, ctx)
+}
+
+// like DeriveSymetricKeys with a kem secret mixed in, an empty kem secret derives what DeriveSymetricKeys does
+func DeriveHybridKeys(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey, kemSecret []byte, salt []byte, ctx KeyContext) ([]byte, []byte, error) {
+
+	if len(kemSecret) == 0 {
+		return DeriveSymetricKeys(privateKey, publicKey, salt, ctx)
+	}
+
+	buf, e := generateShared(privateKey, publicKey)
+	if e != nil {
+		return nil, nil, e
+	}
+	defer wipe(buf)
+
+	// both secrets go in so the key holds as long as either of them does
+	secret := encodeFields([]byte("thorne/hybrid"), buf, kemSecret)
+	defer wipe(secret)
+
+	return deriveKeys(secret, salt, ctx)
+}
+
+func deriveKeys(secret []byte, salt []byte, ctx KeyContext) ([]byte, []byte, error) {
+
+	if len(salt) == 0 {
+		return nil, nil, fmt.Errorf("Missing Key Derivation Salt")
+	}
+
+	info := encodeFields([]byte("thorne/kdf"), []byte(fmt.Sprintf("%d", ctx.Version)), []byte(ctx.Purpose), []byte(ctx.Initiator), []byte(ctx.Responder))
+	kdf := hkdf.New(sha256.New, secret, salt, info)
+
+	k := make([]byte, 64)
+	if _, e := io.ReadFull(kdf, k); e != nil {
+		log.Printf("Failed to read from HKDF: %s", e)
+		return nil, nil, e
+	}
+
+	return k[:32], k[32:], nil
+}
+
+func generateShared(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey) ([]byte, error) {
+
 	if privateKey == nil {
 		return nil, fmt.Errorf("Private Key is NIL")
 	}
@@ -54,16 +148,19 @@ func GenerateSymetricKey(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKe
 		return nil, e
 	}
 
-  hash := sha256.New
-  kdf := hkdf.New(hash, buf, nil, nil)
+	return buf, nil
+}
 
-  k := make([]byte, 32)
-  if _, err := io.ReadFull(kdf, k); err != nil {
-      log.Printf("Failed to read from HKDF: %s", e)
-      return nil, e
-  }
+// length prefix each field so no two different field lists encode the same
+func encodeFields(fields ...[]byte) []byte {
 
-  return k, nil
+	buf := []byte{}
+	for _, f := range fields {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(f)))
+		buf = append(buf, f...)
+	}
+
+	return buf
 }
 
 func MarshalPrivateKey(k *ecdsa.PrivateKey) []byte {
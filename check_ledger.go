@@ -3,11 +3,14 @@ package thorne
 import (
 
 	"bytes"
+	"crypto"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"time"
 
@@ -20,39 +23,8 @@ func CheckLedger(ks *KeyStore, ledger *NewLedger, ledgerNum int) error {
 		return fmt.Errorf("Failed to Locate Matching Ledger: %s", ledger.UUID)
 	}
 
-	llb := LedgerLastBlock{UUID: ks.UUID, Date: time.Now().UTC().Format(time.RFC3339), LedgerUUID: ledger.UUID}
-	lbr := LedgerBlockRequest{LedgerLastBlock: llb, Signature: base64.StdEncoding.EncodeToString(GenerateSignature(ks.PrivateKey, []byte(llb.UUID + llb.Date + llb.LedgerUUID)))}
-	buf, e := json.Marshal(lbr)
-	if e != nil {
-		log.Printf("Failed to Marshal LedgerBlockRequest: %s", e)
-		return e
-	}
-
-	c := &http.Client{}
-	r, e := http.NewRequest("PUT", "https://thorne.app/api/getledger", bytes.NewBuffer(buf))
-	if e != nil {
-		log.Printf("Failed to create request: %s", e)
-		return e
-	}
-
-	x, e := c.Do(r)
+	nl, e := fetchLedger(ks, ledger.UUID)
 	if e != nil {
-		log.Printf("Get Ledger API Failed: %s", e)
-		return e
-	}
-
-	if x.StatusCode != 200 {
-		return fmt.Errorf("Failed to fetch ledger: %d", x.StatusCode)
-	}
-
-	if buf, e = ioutil.ReadAll(x.Body); e != nil {
-		log.Printf("Failed to read response body: %s", e)
-		return e
-	}
-
-	nl := NewLedger{}
-	if e := json.Unmarshal(buf, &nl); e != nil {
-		log.Printf("Failed to unmarshal ledger response: %s", e)
 		return e
 	}
 
@@ -62,14 +34,30 @@ func CheckLedger(ks *KeyStore, ledger *NewLedger, ledgerNum int) error {
 		return nil
 	}
 
-	defer func() {
-		ledger.LastBlock = nl.LastBlock
-	}()
+	// nothing more is read from a connection whose keys changed until they're accepted
+	if ledger.LedgerType == LEDGER_TYPE_ONEONONE {
+		for _, v := range ledger.Users {
+			if v == ks.UUID {
+				continue
+			}
+
+			if e := CheckConnectionKeys(ks, v); e != nil && e != ErrNoConnection {
+				log.Printf("Not reading Ledger %s: %s", ledger.UUID, e)
+				return e
+			}
+		}
+	}
 
 	// so we have a new block id so run down the blocks until we find the one we last downloaded
 	// or we cannot download anymore blocks
 	var block *BlockRequest
+	blocks := []*BlockRequest{}
+	blockURLs := []string{}
 	blockURL := nl.LastBlock
+
+	// nothing can have been written after a verified block that follows it, which bounds when
+	// a block was first seen better than the date its author gave it
+	seen := time.Now()
 	for {
 
 		if blockURL == "-" {
@@ -77,120 +65,349 @@ func CheckLedger(ks *KeyStore, ledger *NewLedger, ledgerNum int) error {
 		}
 
 		log.Printf("Fetching Block %s\n", blockURL)
-		block = GetBlock(ks, blockURL, ledger)
-		log.Printf("Retrieved Block %s\n", block)
+		block, e = fetchBlock(blockURL, seen)
+		log.Printf("Retrieved Block %v\n", block)
 
+		// without the block there's no way further down, leave LastBlock so the walk is tried again
 		if block == nil {
-			break
+			log.Printf("Failed to Fetch Block %s: %s", blockURL, e)
+			return e
+		}
+
+		// a block that doesn't verify is passed over but the chain carries on thru it. when the
+		// keys couldn't be looked up it may well verify later so leave LastBlock for another go
+		if e != nil && !badBlock(e) {
+			log.Printf("Failed to Verify Block %s: %s", blockURL, e)
+			return e
 		}
 
-		str := ""
-		contents, _ := base64.StdEncoding.DecodeString(block.Block.Contents)
-		if ledger.LedgerType == LEDGER_TYPE_PUBLIC || ledger.LedgerType == LEDGER_TYPE_REQUESTS {
-			str = string(contents)
+		if e != nil {
+			log.Printf("Skipping Block %s: %s", blockURL, e)
 		} else {
-			b, e := Decrypt(ks.LedgerKeys[ledger.UUID].SharedSecret, contents)
-			if e != nil {
-				log.Printf("Failed to Decrypt Contents: %s", e)
+			blocks = append(blocks, block)
+			blockURLs = append(blockURLs, blockURL)
+			if t, e := time.Parse(time.RFC3339, block.Block.Date); e == nil && t.Before(seen) {
+				seen = t
 			}
+		}
 
-			str = string(b)
+		if block.ParentBlock == "-" || len(block.ParentBlock) <= 1 {
+			break
 		}
 
-		// based on the block type we received handle the scenario i.e. Key Exchange, Decode HTML Block, etc...
-		body := ""
-		switch block.Block.BlockType {
-		case MessageType:
-			body = str
-		case KeyExchangeInitType:
-			body = str
-			msg, e := UnmarshalKeyExchangeInit([]byte(str))
-			if e != nil {
-				return e
-			}
-			HandleKeyExchangeInit(ks, msg)
+		// when we hit the last block we recorded then we can quit
+		blockURL = block.ParentBlock
 
-			log.Printf("HandleKeyExchangeInit: %s %#v", msg.UUID, ks.PendingConnections[msg.UUID])
-		case KeyExchangeResponseType:
-			body = str
-			msg, e := UnmarshalKeyExchangeResponse([]byte(str))
-			if e != nil {
-				return e
-			}
-			HandleKeyExchangeResponse(ks, msg)
-		case KeyExchangeAckType:
-			body = str
-			msg, e := UnmarshalKeyExchangeAck([]byte(str))
-			if e != nil {
-				return e
+		if blockURL == ledger.LastBlock {
+			break
+		}
+	}
+
+	// handle them oldest first so key changes are seen before the blocks that depend on them
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if e := handleBlock(ks, ledger, blocks[i]); e != nil {
+			// pick up after the last block that was handled so this one comes round again
+			if i + 1 < len(blocks) {
+				ks.SetLastBlock(ledger.UUID, blockURLs[i + 1])
 			}
-			HandleKeyExchangeAck(ks, msg)
-		case ArticleType:
-			body = str
-			msg, e := UnmarshalArticle([]byte(str))
-			if e != nil {
-				return e
+			return e
+		}
+	}
+
+	// set the last block to one we got back from the API
+	ks.SetLastBlock(ledger.UUID, nl.LastBlock)
+	return nil
+}
+
+// decrypt a block and run whatever its type calls for
+func handleBlock(ks *KeyStore, ledger *NewLedger, block *BlockRequest) error {
+
+	date, e := checkBlockDate(block.Block.Date)
+	if e != nil {
+		log.Printf("Skipping %s Block from %s dated %s: %s", block.Block.BlockType, block.Block.UUID, block.Block.Date, e)
+		return nil
+	}
+
+	// ledgers with a policy only act on blocks the right organizations approved
+	if policy, ok := ks.OrgPolicy(ledger.UUID); ok {
+		if e := policy.Check(block); e != nil {
+			log.Printf("Skipping %s Block from %s: %s", block.Block.BlockType, block.Block.UUID, e)
+			return nil
+		}
+	}
+
+	// the same signed payload twice is the same block sent again. signatures can be
+	// re-encoded into other valid ones so they can't be what identifies it
+	id, e := blockID(block)
+	if e != nil {
+		log.Printf("Skipping %s Block from %s: %s", block.Block.BlockType, block.Block.UUID, e)
+		return nil
+	}
+
+	if ks.BlockSeen(ledger.UUID, id) {
+		log.Printf("Ignoring replayed %s Block from %s", block.Block.BlockType, block.Block.UUID)
+		return nil
+	}
+
+	// older than anything we remember so we can't tell if it already ran
+	if hasSideEffects(block.Block.BlockType) && time.Since(date) > ReplayWindow {
+		log.Printf("Ignoring %s Block from %s older than the Replay Window", block.Block.BlockType, block.Block.UUID)
+		return nil
+	}
+
+	// a block is only remembered once it's been handled so one that can't be yet is tried again
+	if e := runBlock(ks, ledger, block); e != nil {
+		if retryBlock(e) {
+			log.Printf("Leaving %s Block from %s for later: %s", block.Block.BlockType, block.Block.UUID, e)
+			return e
+		}
+		log.Printf("Failed to Handle %s Block from %s: %s", block.Block.BlockType, block.Block.UUID, e)
+	}
+
+	ks.MarkBlockSeen(ledger.UUID, id, date)
+	return nil
+}
+
+// verification failures that won't change however often the block is fetched
+func badBlock(e error) bool {
+	return errors.Is(e, ErrBlockSignature) || errors.Is(e, ErrKeyRevoked) || errors.Is(e, ErrKeyRetired) || errors.Is(e, ErrDeviceCertificate) || errors.Is(e, ErrSignatureVersion)
+}
+
+// failures that go away once more of the ledger or the network catches up
+func retryBlock(e error) bool {
+
+	var ne net.Error
+	return errors.Is(e, ErrUnknownEpoch) || errors.Is(e, ErrRatchetNotReady) || errors.As(e, &ne)
+}
+
+// decrypt a block and run whatever its type calls for
+func runBlock(ks *KeyStore, ledger *NewLedger, block *BlockRequest) error {
+
+	str := ""
+	contents, _ := base64.StdEncoding.DecodeString(block.Block.Contents)
+	if ledger.LedgerType == LEDGER_TYPE_PUBLIC || ledger.LedgerType == LEDGER_TYPE_REQUESTS {
+		str = string(contents)
+	} else {
+		var b []byte
+		var e error
+		key, ok := ks.LedgerKey(ledger.UUID)
+		if bytes.HasPrefix(contents, []byte(BLOCK_CIPHER_RATCHET)) {
+			b, e = ratchetOpenBlock(ks, ledger.UUID, &block.Block, contents)
+		} else if !ok && ks.LedgerCipher != nil {
+			// whoever holds the key counts its uses
+			b, e = ks.LedgerCipher.LedgerDecrypt(ledger.UUID, &block.Block, contents)
+		} else {
+			b, e = OpenBlock(key, ledger.UUID, &block.Block, contents)
+
+			// our own writes were counted when we sealed them
+			if e == nil && block.Block.UUID != ks.UUID {
+				countKeyUse(ks, ledger.UUID, blockEpoch(contents))
 			}
-			log.Printf("Article Message: %#v", msg)
-		case HTMLType:
-			body = str
-			msg, e := UnmarshalHTML([]byte(str))
-			if e != nil {
+		}
+		if e != nil {
+			if retryBlock(e) {
 				return e
 			}
-			log.Printf("HTML Message: %#v", msg)
+			log.Printf("Failed to Decrypt Contents: %s", e)
 		}
 
+		str = string(b)
+	}
 
-		log.Printf("Block Contents %s\n", body)
+	// based on the block type we received handle the scenario i.e. Key Exchange, Decode HTML Block, etc...
+	body := ""
+	switch block.Block.BlockType {
+	case MessageType:
+		body = str
+	case KeyExchangeInitType:
+		body = str
+		msg, e := UnmarshalKeyExchangeInit([]byte(str))
+		if e != nil {
+			return e
+		}
+		if e := HandleKeyExchangeInit(ks, msg); e != nil {
+			return e
+		}
 
-		if block == nil {
-			log.Printf("Recieved nil block")
+		pending, _ := ks.PendingConnection(msg.UUID)
+		log.Printf("HandleKeyExchangeInit: %s %#v", msg.UUID, pending)
+	case KeyExchangeResponseType:
+		body = str
+		msg, e := UnmarshalKeyExchangeResponse([]byte(str))
+		if e != nil {
+			return e
+		}
+		if e := HandleKeyExchangeResponse(ks, msg); e != nil {
+			return e
+		}
+	case KeyExchangeAckType:
+		// acks are sealed with the new connection key rather than the ledger's
+		msg, e := OpenKeyExchangeAck(ks, block.Block.UUID, contents)
+		if e != nil {
+			log.Printf("Failed to Open KeyExchangeAck: %s", e)
 			break
 		}
-
-		if block.ParentBlock == "-" || len(block.ParentBlock) <= 1 {
+		if e := HandleKeyExchangeAck(ks, msg); e != nil {
+			return e
+		}
+	case KeyRotationType:
+		msg, e := UnmarshalKeyRotation([]byte(str))
+		if e != nil {
+			log.Printf("Failed to Unmarshal KeyRotation: %s", e)
 			break
 		}
-
-		// when we hit the last block we recorded then we can quit
-		blockURL = block.ParentBlock
-
-		if blockURL == ledger.LastBlock {
+		if e := HandleKeyRotation(ks, ledger.UUID, block.Block.UUID, msg); e != nil {
+			return e
+		}
+	case RatchetInitType:
+		msg, e := UnmarshalRatchetInit([]byte(str))
+		if e != nil {
+			log.Printf("Failed to Unmarshal RatchetInit: %s", e)
 			break
 		}
+		if e := HandleRatchetInit(ks, ledger.UUID, block.Block.UUID, msg); e != nil {
+			return e
+		}
+	case NotificateNewLedgerType:
+		msg, e := UnmarshalNotificateNewLedger([]byte(str))
+		if e != nil {
+			log.Printf("Failed to Unmarshal NotificateNewLedger: %s", e)
+			break
+		}
+		if e := HandleNotificateNewLedger(ks, ledger, block.Block.UUID, msg); e != nil {
+			return e
+		}
+	case ArticleType:
+		body = str
+		msg, e := UnmarshalArticle([]byte(str))
+		if e != nil {
+			return e
+		}
+		log.Printf("Article Message: %#v", msg)
+	case HTMLType:
+		body = str
+		msg, e := UnmarshalHTML([]byte(str))
+		if e != nil {
+			return e
+		}
+		log.Printf("HTML Message: %#v", msg)
 	}
 
-	// set the last block to one we got back from the API
-	ks.Ledgers[ledgerNum].LastBlock = nl.LastBlock
+	log.Printf("Block Contents %s\n", body)
+
 	return nil
 }
 
 func GetBlock(ks *KeyStore, blockURL string, ledger *NewLedger) *BlockRequest {
+	return getBlock(ks, blockURL, ledger, time.Now())
+}
+
+// fetch and verify a block, seen is the latest it can have been written
+func getBlock(ks *KeyStore, blockURL string, ledger *NewLedger, seen time.Time) *BlockRequest {
+
+	br, e := fetchBlock(blockURL, seen)
+	if e != nil {
+		return nil
+	}
+
+	return br
+}
+
+// the block comes back along with the error when it was read but doesn't verify
+func fetchBlock(blockURL string, seen time.Time) (*BlockRequest, error) {
 
 	x, e := http.Get(blockURL)
 	if e != nil {
 		log.Printf("Failed to Fetch Block: %s", e)
-		return nil
+		return nil, e
+	}
+	defer x.Body.Close()
+
+	if x.StatusCode != 200 {
+		return nil, fmt.Errorf("Failed to fetch block: %d", x.StatusCode)
 	}
 
 	buf, e := ioutil.ReadAll(x.Body)
 	if e != nil {
 		log.Printf("Failed to Read Body: %s", e)
-		return nil
+		return nil, e
 	}
 
-	br := &BlockRequest{}
+	br := &BlockRequest{seen: seen}
 	if e := json.Unmarshal(buf, br); e != nil {
 		log.Printf("Failed to Unmarshal Block: %s", e)
-		return nil
+		return nil, e
 	}
 
-  publicKey := GetPublicKey(br.Block.UUID)
-  if !VerifySignature(publicKey, br.Signature, []byte(br.Block.UUID + br.Block.Ledger + br.Block.Contents + br.Block.Date + br.Block.BlockType)) {
-    log.Printf("Failed to verify signature with publicKey: %s", br.Block.UUID)
-    //return nil
+  // SignatureVersion isn't signed so a failure is a failure whatever version the block claims
+  if e := verifyBlockSignature(br); e != nil {
+    log.Printf("Failed to verify signature with publicKey: %s: %s", br.Block.UUID, e)
+    return br, e
   }
 
-	return br
+	return br, nil
+}
+
+// the ledger as the API has it now, the request is signed so only its users can see it
+func fetchLedger(ks *KeyStore, ledgerUUID string) (*NewLedger, error) {
+
+	signer, device, e := ks.signerFor(SignatureVersion)
+	if e != nil {
+		return nil, e
+	}
+
+	return fetchLedgerAs(&http.Client{}, ks.UUID, signer, device, ledgerUUID)
+}
+
+// the getledger request signed as uuid and sent over c, so the alias can ask without the primary UUID
+func fetchLedgerAs(c *http.Client, uuid string, signer crypto.Signer, device string, ledgerUUID string) (*NewLedger, error) {
+
+	llb := LedgerLastBlock{UUID: uuid, Date: time.Now().UTC().Format(time.RFC3339), LedgerUUID: ledgerUUID, Device: device}
+	payload, e := ledgerLastBlockSigningPayload(SignatureVersion, &llb)
+	if e != nil {
+		log.Printf("Failed to build LedgerBlockRequest Signing Payload: %s", e)
+		return nil, e
+	}
+
+	signature, e := GenerateSignature(signer, payload)
+	if e != nil {
+		return nil, e
+	}
+
+	lbr := LedgerBlockRequest{LedgerLastBlock: llb, Signature: base64.StdEncoding.EncodeToString(signature), SignatureVersion: SignatureVersion}
+	buf, e := json.Marshal(lbr)
+	if e != nil {
+		log.Printf("Failed to Marshal LedgerBlockRequest: %s", e)
+		return nil, e
+	}
+
+	r, e := http.NewRequest("PUT", "https://thorne.app/api/getledger", bytes.NewBuffer(buf))
+	if e != nil {
+		log.Printf("Failed to create request: %s", e)
+		return nil, e
+	}
+
+	x, e := c.Do(r)
+	if e != nil {
+		log.Printf("Get Ledger API Failed: %s", e)
+		return nil, e
+	}
+	defer x.Body.Close()
+
+	if x.StatusCode != 200 {
+		return nil, fmt.Errorf("Failed to fetch ledger: %d", x.StatusCode)
+	}
+
+	if buf, e = ioutil.ReadAll(x.Body); e != nil {
+		log.Printf("Failed to read response body: %s", e)
+		return nil, e
+	}
+
+	nl := &NewLedger{}
+	if e := json.Unmarshal(buf, nl); e != nil {
+		log.Printf("Failed to unmarshal ledger response: %s", e)
+		return nil, e
+	}
+
+	return nl, nil
 }
\ No newline at end of file
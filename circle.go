@@ -0,0 +1,254 @@
+package thorne
+
+import (
+
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+)
+
+// ******************************************************
+// Circles
+// A circle shares one group key, every member gets it wrapped
+// over their one on one ledger with the moderator and removing
+// someone moves the circle to a new epoch they never see
+// ******************************************************
+
+var ErrNotModerator 			= errors.New("Only a Moderator can change a Circle")
+var ErrNoDirectLedger 		= errors.New("No One on One Ledger with User")
+
+func CreateCircle(ks *KeyStore, name string, description string, members []string) (string, error) {
+
+	key := GeneratePass()
+
+	ledgerUUID, e := CreateLedger(ks, name, description, "", false, LEDGER_TYPE_CIRCLE, key, members)
+	if e != nil {
+		return "", e
+	}
+
+	ledger, _ := ks.Ledger(ledgerUUID)
+	ledger.Users = circleMembers(members, ks.UUID)
+	if len(ledger.Moderators) == 0 {
+		ledger.Moderators = []string{ks.UUID}
+	}
+	ks.AddLedger(ledger)
+
+	return ledgerUUID, sendCircleKey(ks, ledger, ledger.Users)
+}
+
+// hand the current key to a new member, earlier epochs stay out of their reach
+func AddCircleMember(ks *KeyStore, ledgerUUID string, member string) error {
+
+	ledger, e := moderatedCircle(ks, ledgerUUID)
+	if e != nil {
+		return e
+	}
+
+	for _, v := range ledger.Users {
+		if v == member {
+			return nil
+		}
+	}
+
+	ledger.Users = circleMembers(append(append([]string{}, ledger.Users...), member), ks.UUID)
+	ks.AddLedger(ledger)
+
+	// everyone gets the new member list, the key itself is only new to them
+	return sendCircleKey(ks, ledger, ledger.Users)
+}
+
+// drop a member and rekey so they can't read anything written after they left
+func RemoveCircleMember(ks *KeyStore, ledgerUUID string, member string) error {
+
+	ledger, e := moderatedCircle(ks, ledgerUUID)
+	if e != nil {
+		return e
+	}
+
+	users := []string{}
+	for _, v := range ledger.Users {
+		if v != member {
+			users = append(users, v)
+		}
+	}
+
+	ledger.Users = users
+	ks.AddLedger(ledger)
+
+	return RekeyCircle(ks, ledgerUUID)
+}
+
+// move the circle to a new epoch and send it to the current members
+func RekeyCircle(ks *KeyStore, ledgerUUID string) error {
+
+	ledger, e := moderatedCircle(ks, ledgerUUID)
+	if e != nil {
+		return e
+	}
+
+	e = ks.UpdateLedgerKey(ledgerUUID, func(key *SharedKey) error {
+		*key = key.advance(GeneratePass(), nil)
+		return nil
+	})
+
+	if e != nil {
+		return e
+	}
+
+	key, _ := ks.LedgerKey(ledgerUUID)
+	log.Printf("Rekeyed Circle %s to epoch %d", ledgerUUID, key.Epoch)
+
+	return sendCircleKey(ks, ledger, ledger.Users)
+}
+
+// a circle key turned up on one of our one on one ledgers
+func HandleNotificateNewLedger(ks *KeyStore, ledger *NewLedger, author string, nnl *NotificateNewLedger) error {
+
+	// we see our own blocks when syncing
+	if author == ks.UUID {
+		return nil
+	}
+
+	// only the person on the other end of this ledger can hand us a key thru it
+	if ledger.LedgerType != LEDGER_TYPE_ONEONONE || nnl.From != author || !hasUser(ledger.Users, author) {
+		return fmt.Errorf("NotificateNewLedger for %s from %s didn't come over their ledger", nnl.UUID, author)
+	}
+
+	if nnl.LedgerType != LEDGER_TYPE_CIRCLE {
+		return fmt.Errorf("NotificateNewLedger for unsupported Ledger Type %d", nnl.LedgerType)
+	}
+
+	secret, e := base64.StdEncoding.DecodeString(nnl.Key)
+	if e != nil {
+		return e
+	}
+
+	circle, ok := ks.Ledger(nnl.UUID)
+	if !ok {
+		ks.AddLedger(NewLedger{UUID: nnl.UUID, LedgerType: LEDGER_TYPE_CIRCLE, Moderators: []string{author}, Users: circleMembers(nnl.User, author), LastBlock: "-"})
+		ks.SetLedgerKey(nnl.UUID, SharedKey{Status: SK_STATUS_READY, SharedSecret: secret, Epoch: nnl.Epoch})
+		log.Printf("Joined Circle %s from %s", nnl.UUID, author)
+		return nil
+	}
+
+	if !hasUser(circle.Moderators, author) {
+		return ErrNotModerator
+	}
+
+	circle.Users = circleMembers(nnl.User, author)
+	ks.AddLedger(circle)
+
+	return ks.UpdateLedgerKey(nnl.UUID, func(key *SharedKey) error {
+
+		// membership changes resend the key we already hold
+		if nnl.Epoch <= key.Epoch {
+			return nil
+		}
+
+		// epochs we missed while offline stay unreadable
+		*key = key.advance(secret, nil)
+		key.Epoch = nnl.Epoch
+		log.Printf("Circle %s moved to epoch %d", nnl.UUID, key.Epoch)
+		return nil
+	})
+}
+
+// the one on one ledger we share with user
+func DirectLedger(ks *KeyStore, user string) (string, bool) {
+
+	for _, v := range ks.LedgerList() {
+		if v.LedgerType == LEDGER_TYPE_ONEONONE && hasUser(v.Users, user) {
+			return v.UUID, true
+		}
+	}
+
+	return "", false
+}
+
+func moderatedCircle(ks *KeyStore, ledgerUUID string) (NewLedger, error) {
+
+	ledger, ok := ks.Ledger(ledgerUUID)
+	if !ok {
+		return ledger, ErrNotFound
+	}
+
+	if ledger.LedgerType != LEDGER_TYPE_CIRCLE {
+		return ledger, fmt.Errorf("Ledger %s is not a Circle", ledgerUUID)
+	}
+
+	if !hasUser(ledger.Moderators, ks.UUID) {
+		return ledger, ErrNotModerator
+	}
+
+	return ledger, nil
+}
+
+// wrap the circle's current key for each member over their one on one ledger
+func sendCircleKey(ks *KeyStore, ledger NewLedger, members []string) error {
+
+	key, ok := ks.LedgerKey(ledger.UUID)
+	if !ok {
+		return fmt.Errorf("No Ledger Key for UUID: %s", ledger.UUID)
+	}
+
+	nnl := NotificateNewLedger{From: ks.UUID, UUID: ledger.UUID, Key: base64.StdEncoding.EncodeToString(key.SharedSecret), User: ledger.Users, LedgerType: LEDGER_TYPE_CIRCLE, Epoch: key.Epoch}
+	buf, e := json.Marshal(nnl)
+	if e != nil {
+		log.Printf("Failed to Marshal NotificateNewLedger: %s", e)
+		return e
+	}
+
+	failed := []string{}
+	for _, member := range members {
+
+		if member == ks.UUID {
+			continue
+		}
+
+		direct, ok := DirectLedger(ks, member)
+		if !ok {
+			log.Printf("Failed to send Circle Key to %s: %s", member, ErrNoDirectLedger)
+			failed = append(failed, member)
+			continue
+		}
+
+		if e := WriteBlock(ks, direct, NotificateNewLedgerType, string(buf)); e != nil {
+			log.Printf("Failed to send Circle Key to %s: %s", member, e)
+			failed = append(failed, member)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to send Circle Key to: %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// members without the moderator so nobody sends the key to themselves
+func circleMembers(users []string, moderator string) []string {
+
+	members := []string{}
+	for _, v := range users {
+		if v != moderator && !hasUser(members, v) {
+			members = append(members, v)
+		}
+	}
+
+	return members
+}
+
+func hasUser(users []string, user string) bool {
+
+	for _, v := range users {
+		if v == user {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vaipor/thorne-go"
+
+)
+
+// unlock a keystore and serve it over a unix socket, clients find it thru $THORNE_AUTH_SOCK
+func main() {
+
+	keystore := flag.String("keystore", "keystore.dat", "keystore file to unlock")
+	socket := flag.String("socket", os.Getenv(thorne.AGENT_SOCKET_ENV), "unix socket to listen on")
+	idle := flag.Duration("idle", 15 * time.Minute, "lock after this long without a request (0 never locks)")
+	confirm := flag.Bool("confirm", false, "ask on the terminal before serving each client")
+	flag.Parse()
+
+	in := bufio.NewReader(os.Stdin)
+
+	fmt.Fprint(os.Stderr, "Keystore Password: ")
+	pass, e := readPassword(in)
+	if e != nil {
+		log.Fatalf("Failed to read password: %s", e)
+	}
+
+	a, e := thorne.NewAgent(*keystore, pass, *idle)
+	if e != nil {
+		log.Fatalf("Failed to unlock keystore: %s", e)
+	}
+
+	if *confirm {
+		// every connection asks on the one terminal so only one prompt is up at a time
+		var prompt sync.Mutex
+		a.Approve = func(peer thorne.AgentPeer, op string) bool {
+			prompt.Lock()
+			defer prompt.Unlock()
+
+			fmt.Fprintf(os.Stderr, "Allow pid %d to %s? [y/N] ", peer.PID, op)
+			answer, _ := in.ReadString('\n')
+			return strings.HasPrefix(strings.ToLower(answer), "y")
+		}
+	}
+
+	// a directory only we can open so nobody can guess the path and get there first
+	dir := ""
+	if *socket == "" {
+		if dir, e = os.MkdirTemp("", "thorne-agent-"); e != nil {
+			log.Fatalf("Failed to create socket directory: %s", e)
+		}
+		*socket = filepath.Join(dir, "agent.sock")
+	}
+
+	fmt.Printf("%s=%s; export %s\n", thorne.AGENT_SOCKET_ENV, *socket, thorne.AGENT_SOCKET_ENV)
+	e = a.Serve(*socket)
+	if dir != "" {
+		os.RemoveAll(dir)
+	}
+	log.Fatal(e)
+}
+
+// read a line with the terminal's echo off, when stdin isn't a terminal stty fails and it's read as is
+func readPassword(in *bufio.Reader) ([]byte, error) {
+
+	if stty("-echo") == nil {
+		defer fmt.Fprintln(os.Stderr)
+		defer stty("echo")
+	}
+
+	pass, e := in.ReadBytes('\n')
+	if e != nil {
+		return nil, e
+	}
+
+	return bytes.TrimRight(pass, "\r\n"), nil
+}
+
+func stty(arg string) error {
+
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
@@ -15,9 +15,25 @@ import (
 
 func CreateLedger(ks *KeyStore, name string, description string, site string, hasIcon bool, ledgerType int, key []byte, addtlUsers []string) (string, error) {
 
-	b := LedgerBlock{Name: name, Description: description, Site: site, HasIcon: hasIcon, UUID: ks.UUID, Date: time.Now().UTC().Format(TIME_FORMAT), LedgerType: ledgerType, AdditionalUsers: addtlUsers}
+	signer, device, e := ks.signerFor(SignatureVersion)
+	if e != nil {
+		return "", e
+	}
+
+	b := LedgerBlock{Name: name, Description: description, Site: site, HasIcon: hasIcon, UUID: ks.UUID, Date: time.Now().UTC().Format(TIME_FORMAT), LedgerType: ledgerType, AdditionalUsers: addtlUsers, Device: device}
+
+	payload, e := ledgerSigningPayload(SignatureVersion, &b)
+	if e != nil {
+		log.Printf("Failed to build Ledger Signing Payload: %s", e)
+		return "", e
+	}
+
+	signature, e := GenerateSignature(signer, payload)
+	if e != nil {
+		return "", e
+	}
 
-	br := LedgerRequest{LedgerBlock: b, Signature: base64.StdEncoding.EncodeToString(GenerateSignature(ks.PrivateKey, []byte(b.UUID + fmt.Sprintf("%d", b.LedgerType) + b.Date)))}
+	br := LedgerRequest{LedgerBlock: b, Signature: base64.StdEncoding.EncodeToString(signature), SignatureVersion: SignatureVersion}
 	buf, e := json.Marshal(br)
 	if e != nil {
 		log.Printf("Failed to Marshal Block: %s", e)
@@ -52,12 +68,12 @@ func CreateLedger(ks *KeyStore, name string, description string, site string, ha
 		return "", e
 	}
 
-	ks.Ledgers = append(ks.Ledgers, nl)
-	ks.LedgerKeys[nl.UUID] = SharedKey{Status: SK_STATUS_READY, SharedSecret: key}
+	ks.AddLedger(nl)
+	ks.SetLedgerKey(nl.UUID, SharedKey{Status: SK_STATUS_READY, SharedSecret: key})
 	return nl.UUID, nil
 }
 
 func SaveLedger(ks *KeyStore, ledgerUUID string, ledgerType int, key []byte, addtlUsers []string) {
-	ks.Ledgers = append(ks.Ledgers, NewLedger{UUID: ledgerUUID, LedgerType: ledgerType, Users: addtlUsers, LastBlock: "-"})
-	ks.LedgerKeys[ledgerUUID] = SharedKey{Status: SK_STATUS_READY, SharedSecret: key}
+	ks.AddLedger(NewLedger{UUID: ledgerUUID, LedgerType: ledgerType, Users: addtlUsers, LastBlock: "-"})
+	ks.SetLedgerKey(ledgerUUID, SharedKey{Status: SK_STATUS_READY, SharedSecret: key})
 }
\ No newline at end of file
@@ -43,8 +43,10 @@ func Signup(ks *KeyStore) error {
 		return e
 	}
 
+	ks.mu.Lock()
 	ks.UUID = nu.UUID
 	ks.PublicUUID = nu.AliasUUID
+	ks.mu.Unlock()
 
 	//
 	// save the public key
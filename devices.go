@@ -0,0 +1,331 @@
+package thorne
+
+import (
+
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+)
+
+// ******************************************************
+// Devices
+// Each device signs blocks with its own key, certified by the account's
+// identity key, so losing one device means revoking that key rather
+// than rotating everything
+// ******************************************************
+
+type DeviceCertificate struct {
+
+	UUID 										string 				// the account
+	DeviceID 								string 				// derived from PublicKey
+	Name 										string
+	PublicKey 							string 				// base64 of the device's P521 key
+	Created 								string 				// RFC3339
+	Expires 								string 				// optional, RFC3339
+	Signature 							string 				// by the account's identity key at Created
+
+}
+
+// published next to public.key
+type DeviceList struct {
+
+	UUID 										string
+	Devices 								[]DeviceCertificate
+
+}
+
+type DeviceResponse struct {
+
+	Success 								bool
+	Error 									string
+
+}
+
+var ErrDeviceCertificate 	= errors.New("Invalid Device Certificate")
+var ErrUnknownDevice 			= errors.New("Device is not Certified for this Account")
+
+func deviceCertificatePayload(dc *DeviceCertificate) []byte {
+	return encodeFields([]byte("thorne/device"), []byte(dc.UUID), []byte(dc.DeviceID), []byte(dc.Name), []byte(dc.PublicKey), []byte(dc.Created), []byte(dc.Expires))
+}
+
+func deviceID(key *ecdsa.PublicKey) string {
+	hash := sha256.Sum256([]byte(encodePublicKey(key)))
+	return hex.EncodeToString(hash[:16])
+}
+
+// vouch for a device's key with the account's identity key, expires may be zero for no expiry
+func CertifyDevice(account *KeyStore, name string, deviceKey *ecdsa.PublicKey, expires time.Time) (*DeviceCertificate, error) {
+
+	if deviceKey == nil {
+		return nil, fmt.Errorf("No Device Key to certify")
+	}
+
+	signer := account.IdentitySigner()
+	if signer == nil {
+		return nil, ErrNoIdentityKey
+	}
+
+	dc := &DeviceCertificate{UUID: account.UUID, DeviceID: deviceID(deviceKey), Name: name, PublicKey: encodePublicKey(deviceKey), Created: time.Now().UTC().Format(time.RFC3339)}
+	if !expires.IsZero() {
+		dc.Expires = expires.UTC().Format(time.RFC3339)
+	}
+
+	signature, e := GenerateSignature(signer, deviceCertificatePayload(dc))
+	if e != nil {
+		return nil, e
+	}
+
+	dc.Signature = base64.StdEncoding.EncodeToString(signature)
+	return dc, nil
+}
+
+// give this keystore its own device key, certify it and publish it. the keystore
+// has to hold the identity key and be written afterwards
+func AddDevice(ks *KeyStore, name string) (*DeviceCertificate, error) {
+
+	key := GenerateKey()
+
+	dc, e := CertifyDevice(ks, name, &key.PublicKey, time.Time{})
+	if e != nil {
+		return nil, e
+	}
+
+	if e := PublishDeviceCertificate(dc); e != nil {
+		return nil, e
+	}
+
+	ks.mu.Lock()
+	ks.DeviceKey = key
+	ks.DeviceID = dc.DeviceID
+	ks.mu.Unlock()
+
+	return dc, nil
+}
+
+// certify a key generated on another device and hand back a keystore for it with the
+// account's ledgers and their keys but none of its own private keys. key exchanges,
+// which need the rsa key, and alias posts stay with the account. the device installs
+// its key with InstallDeviceKey, it never sees the account's
+func ProvisionDevice(account *KeyStore, name string, deviceKey *ecdsa.PublicKey, expires time.Time) (*KeyStore, *DeviceCertificate, error) {
+
+	dc, e := CertifyDevice(account, name, deviceKey, expires)
+	if e != nil {
+		return nil, nil, e
+	}
+
+	if e := PublishDeviceCertificate(dc); e != nil {
+		return nil, nil, e
+	}
+
+	ks, e := deviceKeyStore(account, dc)
+	if e != nil {
+		return nil, nil, e
+	}
+
+	return ks, dc, nil
+}
+
+// the keystore ProvisionDevice hands the device dc was made for
+func deviceKeyStore(account *KeyStore, dc *DeviceCertificate) (*KeyStore, error) {
+
+	// round trip thru the disk format so nothing is shared with the account's keystore
+	account.mu.RLock()
+	buf, e := json.Marshal(account.disk())
+	account.mu.RUnlock()
+	if e != nil {
+		log.Printf("Failed to Marshal KeyStore: %s", e)
+		return nil, e
+	}
+	defer wipe(buf)
+
+	ksd := KeyStoreDisk{}
+	if e := json.Unmarshal(buf, &ksd); e != nil {
+		log.Printf("Failed to Unmarshal KeyStore: %s", e)
+		return nil, e
+	}
+
+	ksd.PrivateKey, ksd.PublicUserKey, ksd.RSAKey, ksd.DeviceKey, ksd.PendingSuccession, ksd.PendingIdentityKey = nil, nil, nil, nil, nil, nil
+	ksd.DeviceID = dc.DeviceID
+
+	// only the account ratchets, the device just needs to know which ledgers do
+	for k, v := range ksd.LedgerKeys {
+		if v.Ratchet != nil {
+			v.Ratchet = &RatchetState{}
+			ksd.LedgerKeys[k] = v
+		}
+	}
+
+	return ksd.keyStore(), nil
+}
+
+// give a provisioned keystore the private half of the key its certificate was made for
+func (ks *KeyStore) InstallDeviceKey(key *ecdsa.PrivateKey) error {
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if key == nil || ks.DeviceID == "" || deviceID(&key.PublicKey) != ks.DeviceID {
+		return ErrUnknownDevice
+	}
+
+	ks.DeviceKey = key
+	return nil
+}
+
+// a certificate cutting off a device, like any revocation it can be made ahead of time
+func DeviceRevocationCertificate(account *KeyStore, dc *DeviceCertificate, reason string) (*RevocationCertificate, error) {
+	return newRevocationCertificate(account, REVOKE_DEVICE_KEY, dc.PublicKey, reason)
+}
+
+func PublishDeviceCertificate(dc *DeviceCertificate) error {
+
+	buf, e := json.Marshal(dc)
+	if e != nil {
+		log.Printf("Failed to Marshal DeviceCertificate: %s", e)
+		return e
+	}
+
+	c := &http.Client{}
+	r, e := http.NewRequest("PUT", "https://thorne.app/api/device", bytes.NewBuffer(buf))
+	if e != nil {
+		log.Printf("Failed to create request: %s", e)
+		return e
+	}
+
+	x, e := c.Do(r)
+	if e != nil {
+		log.Printf("Device API Failed: %s", e)
+		return e
+	}
+	defer x.Body.Close()
+
+	if x.StatusCode != 200 {
+		return fmt.Errorf("Failed to publish device: %d", x.StatusCode)
+	}
+
+	if buf, e = ioutil.ReadAll(x.Body); e != nil {
+		log.Printf("Failed to read response body: %s", e)
+		return e
+	}
+
+	resp := DeviceResponse{}
+	if e := json.Unmarshal(buf, &resp); e != nil {
+		log.Printf("Failed to unmarshal device response: %s", e)
+		return e
+	}
+
+	if !resp.Success {
+		return fmt.Errorf("Failed to publish device: %s", resp.Error)
+	}
+
+	return nil
+}
+
+func GetDevices(uuid string) (*DeviceList, error) {
+
+	x, e := http.Get(userKeyURL(uuid, "devices.json"))
+	if e != nil {
+		log.Printf("Failed to get devices: %s", e)
+		return nil, e
+	}
+	defer x.Body.Close()
+
+	if x.StatusCode == 404 || x.StatusCode == 403 {
+		return &DeviceList{UUID: uuid}, nil
+	}
+
+	if x.StatusCode != 200 {
+		return nil, fmt.Errorf("Failed to get devices: %d", x.StatusCode)
+	}
+
+	buf, e := ioutil.ReadAll(x.Body)
+	if e != nil {
+		return nil, e
+	}
+
+	dl := &DeviceList{}
+	if e := json.Unmarshal(buf, dl); e != nil {
+		log.Printf("Failed to unmarshal devices: %s", e)
+		return nil, e
+	}
+
+	return dl, nil
+}
+
+// the key of uuid's device if it was certified and not revoked or expired at date. seen is
+// when what it signed was first seen, revocations apply from then too
+func DeviceKeyAt(uuid string, id string, date string, seen time.Time) (*ecdsa.PublicKey, error) {
+
+	key, _, e := deviceKeyAt(uuid, id, date, seen)
+	return key, e
+}
+
+// DeviceKeyAt along with the account key that certified the device
+func deviceKeyAt(uuid string, id string, date string, seen time.Time) (*ecdsa.PublicKey, *ecdsa.PublicKey, error) {
+
+	dl, e := GetDevices(uuid)
+	if e != nil {
+		return nil, nil, e
+	}
+
+	for i := range dl.Devices {
+
+		dc := &dl.Devices[i]
+		if dc.UUID != uuid || dc.DeviceID != id {
+			continue
+		}
+
+		// the account key that made the certificate has to have been good at the time
+		signer, e := PublicKeyAt(uuid, dc.Created, seen)
+		if e != nil {
+			return nil, nil, e
+		}
+
+		if e := checkIdentityRevocation(uuid, signer, dc.Created, seen); e != nil {
+			return nil, nil, e
+		}
+
+		key, e := dc.keyAt(signer, date, seen)
+		return key, signer, e
+	}
+
+	return nil, nil, ErrUnknownDevice
+}
+
+func (dc *DeviceCertificate) keyAt(signer *ecdsa.PublicKey, date string, seen time.Time) (*ecdsa.PublicKey, error) {
+
+	key := decodePublicKey(dc.PublicKey)
+	if key == nil || deviceID(key) != dc.DeviceID || !VerifySignature(signer, dc.Signature, deviceCertificatePayload(dc)) {
+		return nil, ErrDeviceCertificate
+	}
+
+	at, e := time.Parse(time.RFC3339, date)
+	if e != nil {
+		return nil, e
+	}
+
+	created, e := time.Parse(time.RFC3339, dc.Created)
+	if e != nil || at.Before(created) {
+		return nil, ErrDeviceCertificate
+	}
+
+	if expires, e := time.Parse(time.RFC3339, dc.Expires); e == nil && (!at.Before(expires) || !seen.Before(expires)) {
+		return nil, ErrDeviceCertificate
+	}
+
+	if e := checkDeviceRevocation(dc.UUID, dc.PublicKey, date, seen); e != nil {
+		return nil, e
+	}
+
+	return key, nil
+}
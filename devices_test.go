@@ -0,0 +1,57 @@
+package thorne
+
+import (
+
+	"testing"
+	"time"
+
+)
+
+// a provisioned device reads and writes the account's ledgers but holds none of its private keys
+func TestDeviceKeyStore(t *testing.T) {
+
+	account := &KeyStore{UUID: "owner", PublicUUID: "powner", PrivateKey: GenerateKey(), PublicUserKey: GenerateKey()}
+	account.RSAKey, _ = rsaGenerateKey()
+	account.AddLedger(NewLedger{UUID: "ledger", LedgerType: LEDGER_TYPE_PRIVATE})
+	account.SetLedgerKey("ledger", SharedKey{SharedSecret: GeneratePass(), Epoch: 1})
+
+	key := GenerateKey()
+	dc, e := CertifyDevice(account, "laptop", &key.PublicKey, time.Time{})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	ks, e := deviceKeyStore(account, dc)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if ks.PrivateKey != nil || ks.PublicUserKey != nil || ks.RSAKey != nil || ks.DeviceKey != nil || ks.PendingIdentityKey != nil {
+		t.Fatal("Device was handed one of the account's private keys")
+	}
+
+	if ks.IdentitySigner() != nil || ks.RSADecrypter() != nil {
+		t.Fatal("Device can sign or decrypt as the account")
+	}
+
+	if ks.UUID != account.UUID || ks.DeviceID != dc.DeviceID {
+		t.Fatalf("Device keystore is for %s %s", ks.UUID, ks.DeviceID)
+	}
+
+	if k, ok := ks.LedgerKey("ledger"); !ok || k.Epoch != 1 {
+		t.Fatal("Device didn't get the ledger keys")
+	}
+
+	// key exchanges need the rsa key so they fail instead of reaching for one that isn't there
+	if _, e := keyExchangeDecrypt(KE_VERSION_OAEP, ks.RSADecrypter(), "AAAA"); e != ErrNoRSAKey {
+		t.Fatalf("Expected ErrNoRSAKey, have %v", e)
+	}
+
+	if e := ks.InstallDeviceKey(key); e != nil {
+		t.Fatal(e)
+	}
+
+	if _, device, e := ks.signerFor(SIGNATURE_V2); e != nil || device != dc.DeviceID {
+		t.Fatalf("Device can't sign its blocks: %v", e)
+	}
+}
@@ -0,0 +1,348 @@
+package thorne
+
+import (
+
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+
+)
+
+// ******************************************************
+// Identity Export
+// Move a KeyStore between machines under its own passphrase
+// ******************************************************
+const IDENTITY_EXPORT_VERSION = 1
+const IDENTITY_EXPORT_ITERATIONS = 600000
+const IDENTITY_EXPORT_MIN_ITERATIONS = 100000
+const IDENTITY_EXPORT_MAX_ITERATIONS = 10000000
+const IDENTITY_EXPORT_SALT_SIZE = 32
+const IDENTITY_ARMOR_TYPE = "THORNE IDENTITY"
+
+// what parts of the keystore to include in an export
+const (
+
+	EXPORT_IDENTITY 				= 1 << iota 		// UUIDs, identity, alias and rsa keys
+	EXPORT_LEDGER_KEYS
+	EXPORT_LEDGERS
+	EXPORT_CONNECTIONS
+	EXPORT_METADATA
+	EXPORT_SUCCESSION 									// an identity rotation that hasn't finished and the key it hands over to
+	EXPORT_DEVICE 										// this device's id and subkey
+	EXPORT_ORG_POLICIES
+
+	EXPORT_ALL 							= EXPORT_IDENTITY | EXPORT_LEDGER_KEYS | EXPORT_LEDGERS | EXPORT_CONNECTIONS | EXPORT_METADATA | EXPORT_SUCCESSION | EXPORT_DEVICE | EXPORT_ORG_POLICIES
+
+)
+
+var ErrExportVersion 			= errors.New("Unsupported Identity Export Version")
+var ErrExportCorrupt 			= errors.New("Identity Export is Corrupt")
+var ErrExportPassphrase 	= errors.New("Identity Export Passphrase is Incorrect")
+var ErrExportCustody 			= errors.New("Identity Keys are held outside the KeyStore and can't be Exported")
+var ErrIdentityExists 		= errors.New("KeyStore already holds a different Identity")
+
+// the encrypted envelope that is written out
+type IdentityExport struct {
+
+	Version 								int
+	Contents 								int 						// EXPORT_* flags describing the bundle
+	Salt 										[]byte 					// salt for the passphrase derivation
+	Iterations 							int 						// pbkdf2 iterations
+	Ciphertext 							[]byte 					// nonce + ciphertext of the IdentityBundle
+	Checksum 								[]byte 					// sha256 over the fields above to detect corruption
+
+}
+
+// the plaintext contents of an export
+type IdentityBundle struct {
+
+	Version 								int
+	Contents 								int
+	UUID 										string
+	PublicUUID 							string
+	PrivateKey							[]byte
+	PublicUserKey 					[]byte
+	RSAKey 									[]byte
+	LedgerKeys 							map[string]SharedKey
+	Ledgers 								[]NewLedger
+	Connections 						[]Connection
+	Metadata 								map[string]string
+	PendingSuccession 			*KeySuccession
+	PendingIdentityKey 			[]byte
+	DeviceID 								string
+	DeviceKey 							[]byte
+	OrgPolicies 						map[string]OrgPolicy
+
+}
+
+// export the requested parts of a keystore encrypted with the passphrase
+func ExportIdentity(ks *KeyStore, passphrase []byte, contents int) ([]byte, error) {
+
+	if contents & EXPORT_ALL == 0 {
+		return nil, fmt.Errorf("Nothing to Export")
+	}
+
+	ib := IdentityBundle{Version: IDENTITY_EXPORT_VERSION, Contents: contents & EXPORT_ALL}
+
+	ks.mu.RLock()
+	if contents & EXPORT_IDENTITY != 0 {
+		// import needs every key so a bundle missing any would never open
+		if ks.Signer != nil || ks.Decrypter != nil || ks.PrivateKey == nil || ks.PublicUserKey == nil || ks.RSAKey == nil {
+			ks.mu.RUnlock()
+			return nil, ErrExportCustody
+		}
+
+		ib.UUID = ks.UUID
+		ib.PublicUUID = ks.PublicUUID
+		ib.PrivateKey = EncodeKey(ks.PrivateKey)
+		ib.PublicUserKey = EncodeKey(ks.PublicUserKey)
+		ib.RSAKey = EncodeRSAKey(ks.RSAKey)
+	}
+
+	if contents & EXPORT_LEDGER_KEYS != 0 {
+		ib.LedgerKeys = ks.LedgerKeys
+	}
+
+	if contents & EXPORT_LEDGERS != 0 {
+		ib.Ledgers = ks.Ledgers
+	}
+
+	if contents & EXPORT_CONNECTIONS != 0 {
+		ib.Connections = ks.Connections
+	}
+
+	if contents & EXPORT_METADATA != 0 {
+		ib.Metadata = ks.Metadata
+	}
+
+	if contents & EXPORT_SUCCESSION != 0 && ks.PendingSuccession != nil && ks.PendingIdentityKey != nil {
+		ib.PendingSuccession = ks.PendingSuccession
+		ib.PendingIdentityKey = EncodeKey(ks.PendingIdentityKey)
+	}
+
+	if contents & EXPORT_DEVICE != 0 && ks.DeviceKey != nil {
+		ib.DeviceID = ks.DeviceID
+		ib.DeviceKey = EncodeKey(ks.DeviceKey)
+	}
+
+	if contents & EXPORT_ORG_POLICIES != 0 {
+		ib.OrgPolicies = ks.OrgPolicies
+	}
+
+	buf, e := json.Marshal(ib)
+	ks.mu.RUnlock()
+	if e != nil {
+		log.Printf("Failed to Marshal IdentityBundle: %s", e)
+		return nil, e
+	}
+	defer wipe(buf)
+
+	ie := IdentityExport{Version: IDENTITY_EXPORT_VERSION, Contents: ib.Contents, Iterations: IDENTITY_EXPORT_ITERATIONS, Salt: make([]byte, IDENTITY_EXPORT_SALT_SIZE)}
+	if _, e := io.ReadFull(rand.Reader, ie.Salt); e != nil {
+		log.Printf("Failed to read from crypto/rand: %s", e)
+		return nil, e
+	}
+
+	key, e := pbkdf2.Key(sha256.New, string(passphrase), ie.Salt, ie.Iterations, 32)
+	if e != nil {
+		log.Printf("Failed to derive export key: %s", e)
+		return nil, e
+	}
+	defer wipe(key)
+
+	cipherBuf, nonce, e := Crypt(key, buf)
+	if e != nil {
+		log.Printf("Failed to AES Encrypt: %s", e)
+		return nil, e
+	}
+
+	ie.Ciphertext = append(nonce, cipherBuf...)
+	ie.Checksum = ie.checksum()
+
+	return json.Marshal(ie)
+}
+
+// export as a pem style block of text suitable for pasting
+func ExportIdentityArmored(ks *KeyStore, passphrase []byte, contents int) (string, error) {
+
+	buf, e := ExportIdentity(ks, passphrase, contents)
+	if e != nil {
+		return "", e
+	}
+
+	block := &pem.Block{Type: IDENTITY_ARMOR_TYPE, Headers: map[string]string{"Version": strconv.Itoa(IDENTITY_EXPORT_VERSION)}, Bytes: buf}
+	return string(pem.EncodeToMemory(block)), nil
+}
+
+// decrypt an export (raw or armored) and merge it into ks, when ks is nil a new keystore is returned
+func ImportIdentity(ks *KeyStore, passphrase []byte, buf []byte) (*KeyStore, error) {
+
+	if trimmed := bytes.TrimSpace(buf); bytes.HasPrefix(trimmed, []byte("-----BEGIN")) {
+		block, _ := pem.Decode(trimmed)
+		if block == nil || block.Type != IDENTITY_ARMOR_TYPE {
+			return nil, ErrExportCorrupt
+		}
+		buf = block.Bytes
+	}
+
+	ie := IdentityExport{}
+	if e := json.Unmarshal(buf, &ie); e != nil {
+		log.Printf("Failed to Unmarshal IdentityExport: %s", e)
+		return nil, ErrExportCorrupt
+	}
+
+	if ie.Version != IDENTITY_EXPORT_VERSION {
+		return nil, ErrExportVersion
+	}
+
+	if subtle.ConstantTimeCompare(ie.Checksum, ie.checksum()) != 1 || len(ie.Ciphertext) < 12 || len(ie.Salt) < IDENTITY_EXPORT_SALT_SIZE {
+		return nil, ErrExportCorrupt
+	}
+
+	// too few is a weak export and too many would hang us deriving the key
+	if ie.Iterations < IDENTITY_EXPORT_MIN_ITERATIONS || ie.Iterations > IDENTITY_EXPORT_MAX_ITERATIONS {
+		return nil, ErrExportCorrupt
+	}
+
+	key, e := pbkdf2.Key(sha256.New, string(passphrase), ie.Salt, ie.Iterations, 32)
+	if e != nil {
+		log.Printf("Failed to derive export key: %s", e)
+		return nil, e
+	}
+	defer wipe(key)
+
+	plaintext, e := Decrypt(key, ie.Ciphertext)
+	if e != nil {
+		return nil, ErrExportPassphrase
+	}
+	defer wipe(plaintext)
+
+	ib := IdentityBundle{}
+	if e := json.Unmarshal(plaintext, &ib); e != nil {
+		log.Printf("Failed to Unmarshal IdentityBundle: %s", e)
+		return nil, ErrExportCorrupt
+	}
+
+	// the envelope isn't covered by the cipher so make sure it agrees with what was sealed
+	if ib.Version != ie.Version || ib.Contents != ie.Contents {
+		return nil, ErrExportCorrupt
+	}
+
+	if ks == nil {
+		ks = &KeyStore{Connections: []Connection{}, LedgerKeys: map[string]SharedKey{}, Ledgers: []NewLedger{}, PendingConnections: map[string]SharedKey{}, Metadata: map[string]string{}}
+	}
+
+	identity := ib.Contents & EXPORT_IDENTITY != 0
+	succession := ib.Contents & EXPORT_SUCCESSION != 0 && ib.PendingSuccession != nil
+	device := ib.Contents & EXPORT_DEVICE != 0 && ib.DeviceID != ""
+
+	var privateKey, publicUserKey, nextKey, deviceKey *ecdsa.PrivateKey
+	var rsaKey *rsa.PrivateKey
+	if identity {
+		privateKey, publicUserKey, rsaKey = DecodeKey(ib.PrivateKey), DecodeKey(ib.PublicUserKey), DecodeRSAKey(ib.RSAKey)
+		if privateKey == nil || publicUserKey == nil || rsaKey == nil {
+			return nil, ErrExportCorrupt
+		}
+	}
+
+	if succession {
+		if nextKey = DecodeKey(ib.PendingIdentityKey); nextKey == nil || encodePublicKey(&nextKey.PublicKey) != ib.PendingSuccession.NextKey {
+			return nil, ErrExportCorrupt
+		}
+	}
+
+	if device {
+		if deviceKey = DecodeKey(ib.DeviceKey); deviceKey == nil || deviceID(&deviceKey.PublicKey) != ib.DeviceID {
+			return nil, ErrExportCorrupt
+		}
+	}
+
+	ks.mu.Lock()
+	uuid, currentKey := ks.UUID, ks.PrivateKey
+	if identity {
+		// only the same identity can be imported again, anything else would lose the one we have
+		if (ks.UUID != "" && ks.UUID != ib.UUID) || (ks.PrivateKey != nil && !ks.PrivateKey.Equal(privateKey)) || ks.Signer != nil {
+			ks.mu.Unlock()
+			return nil, ErrIdentityExists
+		}
+		uuid, currentKey = ib.UUID, privateKey
+	}
+
+	// a succession hands over from the identity key so it's no use to any other, and a
+	// device belongs to one account and stands in for any device we already are
+	if succession && (currentKey == nil || uuid != ib.PendingSuccession.UUID || encodePublicKey(&currentKey.PublicKey) != ib.PendingSuccession.PreviousKey) {
+		ks.mu.Unlock()
+		return nil, ErrIdentityExists
+	}
+
+	if device && (uuid == "" || (ks.DeviceID != "" && ks.DeviceID != ib.DeviceID)) {
+		ks.mu.Unlock()
+		return nil, ErrIdentityExists
+	}
+
+	if identity {
+		ks.UUID = ib.UUID
+		ks.PublicUUID = ib.PublicUUID
+		ks.PrivateKey = privateKey
+		ks.PublicUserKey = publicUserKey
+		ks.RSAKey = rsaKey
+	}
+
+	if succession {
+		ks.PendingSuccession = ib.PendingSuccession
+		ks.PendingIdentityKey = nextKey
+	}
+
+	if device {
+		ks.DeviceID = ib.DeviceID
+		ks.DeviceKey = deviceKey
+	}
+	ks.mu.Unlock()
+
+	for k, v := range ib.LedgerKeys {
+		ks.SetLedgerKey(k, v)
+	}
+
+	for _, v := range ib.Ledgers {
+		if _, ok := ks.Ledger(v.UUID); !ok {
+			ks.AddLedger(v)
+		}
+	}
+
+	for _, v := range ib.Connections {
+		if _, ok := ks.Connection(v.UUID); !ok {
+			ks.AddConnection(v)
+		}
+	}
+
+	for k, v := range ib.Metadata {
+		ks.SetMetadata(k, v)
+	}
+
+	for k, v := range ib.OrgPolicies {
+		ks.SetOrgPolicy(k, v)
+	}
+
+	return ks, nil
+}
+
+func (ie *IdentityExport) checksum() []byte {
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%d:%d:", ie.Version, ie.Contents, ie.Iterations)
+	h.Write(ie.Salt)
+	h.Write(ie.Ciphertext)
+
+	return h.Sum(nil)
+}
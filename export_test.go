@@ -0,0 +1,78 @@
+package thorne
+
+import (
+
+	"reflect"
+	"testing"
+
+)
+
+// everything EXPORT_ALL covers comes back the way it went out
+func TestExportIdentityRoundTrip(t *testing.T) {
+
+	ks := &KeyStore{UUID: "owner", PublicUUID: "powner", PrivateKey: GenerateKey(), PublicUserKey: GenerateKey(), Metadata: map[string]string{"name": "owner"}}
+	ks.RSAKey, _ = rsaGenerateKey()
+	ks.SetLedgerKey("ledger", SharedKey{SharedSecret: GeneratePass(), Epoch: 2})
+	ks.AddLedger(NewLedger{UUID: "ledger", LedgerType: LEDGER_TYPE_PRIVATE})
+	ks.AddConnection(Connection{UUID: "friend", Name: "Friend"})
+	ks.SetOrgPolicy("ledger", OrgPolicy{Orgs: []string{"org"}, Required: 1})
+
+	ks.PendingIdentityKey = GenerateKey()
+	ks.PendingSuccession = &KeySuccession{UUID: ks.UUID, Sequence: 1, PreviousKey: encodePublicKey(&ks.PrivateKey.PublicKey), NextKey: encodePublicKey(&ks.PendingIdentityKey.PublicKey)}
+
+	ks.DeviceKey = GenerateKey()
+	ks.DeviceID = deviceID(&ks.DeviceKey.PublicKey)
+
+	pass := []byte("passphrase")
+	buf, e := ExportIdentity(ks, pass, EXPORT_ALL)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	rks, e := ImportIdentity(nil, pass, buf)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if rks.UUID != ks.UUID || rks.PublicUUID != ks.PublicUUID || !rks.PrivateKey.Equal(ks.PrivateKey) || !rks.PublicUserKey.Equal(ks.PublicUserKey) || !rks.RSAKey.Equal(ks.RSAKey) {
+		t.Fatal("Identity didn't survive the Export")
+	}
+
+	if !reflect.DeepEqual(rks.PendingSuccession, ks.PendingSuccession) || !rks.PendingIdentityKey.Equal(ks.PendingIdentityKey) {
+		t.Fatal("Pending Succession didn't survive the Export")
+	}
+
+	if rks.DeviceID != ks.DeviceID || !rks.DeviceKey.Equal(ks.DeviceKey) {
+		t.Fatal("Device didn't survive the Export")
+	}
+
+	for _, check := range []struct {
+		name 			string
+		have, want 		interface{}
+	}{
+		{"Ledger Keys", rks.LedgerKeys, ks.LedgerKeys},
+		{"Ledgers", rks.LedgerList(), ks.LedgerList()},
+		{"Connections", rks.Connections, ks.Connections},
+		{"Metadata", rks.Metadata, ks.Metadata},
+		{"Org Policies", rks.OrgPolicies, ks.OrgPolicies},
+	} {
+		if !reflect.DeepEqual(check.have, check.want) {
+			t.Fatalf("%s didn't survive the Export: %#v", check.name, check.have)
+		}
+	}
+
+	// the succession and device belong to the owner's identity so nobody else takes them
+	buf, e = ExportIdentity(ks, pass, EXPORT_SUCCESSION | EXPORT_DEVICE)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	other := &KeyStore{UUID: "other", PrivateKey: GenerateKey()}
+	if _, e := ImportIdentity(other, pass, buf); e != ErrIdentityExists {
+		t.Fatalf("Expected ErrIdentityExists, have %v", e)
+	}
+
+	if other.PendingSuccession != nil || other.DeviceKey != nil {
+		t.Fatal("Import left part of another identity behind")
+	}
+}
@@ -0,0 +1,345 @@
+package thorne
+
+import (
+
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+)
+
+// ******************************************************
+// Identity Rotation
+// Replace the account's identity key, the old key signs a succession
+// statement naming the new one so blocks from before the change can
+// still be checked against the key that was valid when they were written
+// ******************************************************
+
+// one step in an account's key history, signed by the key it replaces and the key it introduces
+type KeySuccession struct {
+
+	UUID 										string 				// the account
+	Sequence 								int 					// 1 for the first rotation
+	PreviousKey 						string 				// base64 of the key being retired
+	NextKey 								string 				// base64 of the key taking over
+	Date 										string 				// when the new key takes over (RFC3339)
+	Reason 									string
+	Signature 							string 				// by PreviousKey
+	NextSignature 					string 				// by NextKey, proves the new key is held by the account
+
+}
+
+// published next to public.key, oldest first
+type KeyHistory struct {
+
+	UUID 										string
+	Successions 						[]KeySuccession
+
+}
+
+type IdentityRotationRequest struct {
+
+	Succession 							KeySuccession
+
+}
+
+type IdentityRotationResponse struct {
+
+	Success 								bool
+	Error 									string
+	PublicKeyURL 						string 				// signed URL to upload the new public.key
+
+}
+
+var ErrKeyHistory 				= errors.New("Key History doesn't chain to the current Public Key")
+var ErrKeyRetired 				= errors.New("Key was Retired before the Signature was first Seen")
+
+func keySuccessionPayload(ksn *KeySuccession) []byte {
+	return encodeFields([]byte("thorne/succession"), []byte(ksn.UUID), []byte(strconv.Itoa(ksn.Sequence)), []byte(ksn.PreviousKey), []byte(ksn.NextKey), []byte(ksn.Date), []byte(ksn.Reason))
+}
+
+// generate a new identity key, publish its succession and switch the keystore over to it.
+// the new key is written to the keystore before anything is published so a rotation that
+// fails part way can be finished by calling this again. devices certified by the old key
+// have to be certified again
+func RotateIdentityKey(pass []byte, filename string, ks *KeyStore, reason string) error {
+
+	ks.mu.RLock()
+	custody := ks.Signer != nil || ks.PrivateKey == nil
+	ks.mu.RUnlock()
+
+	if custody {
+		return fmt.Errorf("Identity Key is held outside the KeyStore and can't be rotated here")
+	}
+
+	history, e := GetKeyHistory(ks.UUID)
+	if e != nil {
+		return e
+	}
+
+	ks.mu.RLock()
+	oldKey, newKey, ksn := ks.PrivateKey, ks.PendingIdentityKey, ks.PendingSuccession
+	ks.mu.RUnlock()
+
+	if ksn == nil || newKey == nil {
+		newKey = GenerateKey()
+		ksn = &KeySuccession{UUID: ks.UUID, Sequence: len(history.Successions) + 1, PreviousKey: encodePublicKey(&oldKey.PublicKey), NextKey: encodePublicKey(&newKey.PublicKey), Reason: reason}
+	}
+
+	// until the API has taken it the succession can be dated again, it takes over from when it's published
+	published := len(history.Successions) >= ksn.Sequence && history.Successions[ksn.Sequence - 1].NextKey == ksn.NextKey
+	if !published {
+		if ksn.Sequence != len(history.Successions) + 1 || ksn.PreviousKey != encodePublicKey(&oldKey.PublicKey) {
+			return ErrKeyHistory
+		}
+
+		// the pending succession is the keystore's so it's dated again on a copy
+		next := *ksn
+		ksn = &next
+
+		ksn.Date = time.Now().UTC().Format(time.RFC3339)
+		payload := keySuccessionPayload(ksn)
+
+		signature, e := GenerateSignature(oldKey, payload)
+		if e != nil {
+			return e
+		}
+
+		nextSignature, e := GenerateSignature(newKey, payload)
+		if e != nil {
+			return e
+		}
+
+		ksn.Signature = base64.StdEncoding.EncodeToString(signature)
+		ksn.NextSignature = base64.StdEncoding.EncodeToString(nextSignature)
+	}
+
+	ks.mu.Lock()
+	ks.PendingSuccession = ksn
+	ks.PendingIdentityKey = newKey
+	ks.mu.Unlock()
+
+	if e := WriteKeyStore(pass, filename, ks); e != nil {
+		return e
+	}
+
+	// the API answers a succession it already has with a new upload URL so this is safe to repeat
+	buf, e := json.Marshal(IdentityRotationRequest{Succession: *ksn})
+	if e != nil {
+		log.Printf("Failed to Marshal IdentityRotationRequest: %s", e)
+		return e
+	}
+
+	c := &http.Client{}
+	r, e := http.NewRequest("PUT", "https://thorne.app/api/rotatekey", bytes.NewBuffer(buf))
+	if e != nil {
+		log.Printf("Failed to create request: %s", e)
+		return e
+	}
+
+	x, e := c.Do(r)
+	if e != nil {
+		log.Printf("Rotate Key API Failed: %s", e)
+		return e
+	}
+
+	if x.StatusCode != 200 {
+		return fmt.Errorf("Failed to rotate key: %d", x.StatusCode)
+	}
+
+	if buf, e = ioutil.ReadAll(x.Body); e != nil {
+		log.Printf("Failed to read response body: %s", e)
+		return e
+	}
+
+	resp := IdentityRotationResponse{}
+	if e := json.Unmarshal(buf, &resp); e != nil {
+		log.Printf("Failed to unmarshal rotate key response: %s", e)
+		return e
+	}
+
+	if !resp.Success {
+		return fmt.Errorf("Failed to rotate key: %s", resp.Error)
+	}
+
+	r, e = http.NewRequest("PUT", resp.PublicKeyURL, bytes.NewBufferString(ksn.NextKey))
+	if e != nil {
+		log.Printf("Failed to create request for public key: %s", e)
+		return e
+	}
+
+	r.Header.Add("Content-Type", "application/octet-stream")
+
+	if x, e = c.Do(r); e != nil {
+		log.Printf("Put Public Key Failed: %s", e)
+		return e
+	}
+
+	if x.StatusCode != 200 {
+		return fmt.Errorf("Failed to upload public key: %d", x.StatusCode)
+	}
+
+	ks.mu.Lock()
+	ks.PrivateKey = newKey
+	ks.PendingSuccession = nil
+	ks.PendingIdentityKey = nil
+	ks.mu.Unlock()
+
+	if e := WriteKeyStore(pass, filename, ks); e != nil {
+		return e
+	}
+
+	log.Printf("Rotated Identity Key to sequence %d", ksn.Sequence)
+	return nil
+}
+
+// fetch an account's key history, accounts that never rotated have an empty one
+func GetKeyHistory(uuid string) (*KeyHistory, error) {
+
+	x, e := http.Get(userKeyURL(uuid, "succession.json"))
+	if e != nil {
+		log.Printf("Failed to get key history: %s", e)
+		return nil, e
+	}
+	defer x.Body.Close()
+
+	if x.StatusCode == 404 || x.StatusCode == 403 {
+		return &KeyHistory{UUID: uuid}, nil
+	}
+
+	if x.StatusCode != 200 {
+		return nil, fmt.Errorf("Failed to get key history: %d", x.StatusCode)
+	}
+
+	buf, e := ioutil.ReadAll(x.Body)
+	if e != nil {
+		return nil, e
+	}
+
+	history := &KeyHistory{}
+	if e := json.Unmarshal(buf, history); e != nil {
+		log.Printf("Failed to unmarshal key history: %s", e)
+		return nil, e
+	}
+
+	if history.UUID != uuid {
+		return nil, ErrKeyHistory
+	}
+
+	return history, nil
+}
+
+// the identity key that was valid for uuid at date, seen is when what it signed was first seen
+func PublicKeyAt(uuid string, date string, seen time.Time) (*ecdsa.PublicKey, error) {
+
+	current := GetPublicKey(uuid)
+	if current == nil || current.X == nil {
+		return nil, fmt.Errorf("No Public Key for %s", uuid)
+	}
+
+	history, e := GetKeyHistory(uuid)
+	if e != nil {
+		return nil, e
+	}
+
+	return history.KeyAt(current, date, seen)
+}
+
+// check every step of the history and pick the key that was in use at date, the last
+// step has to hand over to current. date is the signer's word so a retired key is only
+// taken for something seen before it was retired
+func (h *KeyHistory) KeyAt(current *ecdsa.PublicKey, date string, seen time.Time) (*ecdsa.PublicKey, error) {
+
+	if len(h.Successions) == 0 {
+		return current, nil
+	}
+
+	at, e := time.Parse(time.RFC3339, date)
+	if e != nil {
+		return nil, e
+	}
+
+	var key *ecdsa.PublicKey
+	var last, retired time.Time
+	for i := range h.Successions {
+
+		ksn := &h.Successions[i]
+		prev, next := decodePublicKey(ksn.PreviousKey), decodePublicKey(ksn.NextKey)
+		if prev == nil || next == nil || ksn.UUID != h.UUID || ksn.Sequence != i + 1 {
+			return nil, ErrKeyHistory
+		}
+
+		if i > 0 && ksn.PreviousKey != h.Successions[i - 1].NextKey {
+			return nil, ErrKeyHistory
+		}
+
+		payload := keySuccessionPayload(ksn)
+		if !VerifySignature(prev, ksn.Signature, payload) || !VerifySignature(next, ksn.NextSignature, payload) {
+			return nil, ErrKeyHistory
+		}
+
+		started, e := time.Parse(time.RFC3339, ksn.Date)
+		if e != nil || started.Before(last) {
+			return nil, ErrKeyHistory
+		}
+		last = started
+
+		if key == nil && at.Before(started) {
+			key = prev
+			retired = started
+		}
+	}
+
+	if !current.Equal(decodePublicKey(h.Successions[len(h.Successions) - 1].NextKey)) {
+		return nil, ErrKeyHistory
+	}
+
+	if key == nil {
+		key = current
+	}
+
+	if !retired.IsZero() && !seen.Before(retired) {
+		return nil, ErrKeyRetired
+	}
+
+	return key, nil
+}
+
+func encodePublicKey(key *ecdsa.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(elliptic.Marshal(elliptic.P521(), key.X, key.Y))
+}
+
+func decodePublicKey(s string) *ecdsa.PublicKey {
+
+	b, e := base64.StdEncoding.DecodeString(s)
+	if e != nil {
+		return nil
+	}
+
+	x, y := elliptic.Unmarshal(elliptic.P521(), b)
+	if x == nil {
+		return nil
+	}
+
+	return &ecdsa.PublicKey{Curve: elliptic.P521(), X: x, Y: y}
+}
+
+func userKeyURL(uuid string, file string) string {
+
+	host := "users"
+	if strings.HasPrefix(uuid, "p") {
+		host = "publicusers"
+	}
+
+	return "https://" + host + ".thorne.app/" + uuid + "/" + file
+}
@@ -0,0 +1,290 @@
+package thorne
+
+import (
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+)
+
+// ******************************************************
+// Key Rotation
+// Move a ledger to a fresh key while keeping the old epochs
+// around so its history can still be read
+// ******************************************************
+
+// one on one ledgers start a rotation on the next write once their key is this old, 0 disables it
+var KeyRotationPeriod = 30 * 24 * time.Hour
+
+const KDF_PURPOSE_ROTATION = "ledger-rotation"
+
+// the secret for a given epoch of this key
+func (sk SharedKey) Secret(epoch int) ([]byte, bool) {
+
+	if epoch == sk.Epoch {
+		return sk.SharedSecret, sk.SharedSecret != nil
+	}
+
+	secret, ok := sk.Epochs[epoch]
+	return secret, ok
+}
+
+// the key moved to the next epoch with secret, the current one is kept for history
+func (sk SharedKey) advance(secret []byte, authKey []byte) SharedKey {
+
+	epochs := map[int][]byte{}
+	for k, v := range sk.Epochs {
+		epochs[k] = v
+	}
+	epochs[sk.Epoch] = sk.SharedSecret
+
+	sk.Epochs = epochs
+	sk.Epoch++
+	sk.SharedSecret = secret
+	sk.AuthKey = authKey
+	sk.EpochStarted = time.Now().UTC().Format(TIME_FORMAT)
+	sk.RotationKey = nil
+	sk.Uses = 0
+
+	return sk
+}
+
+// rotate a ledger's key now, private ledgers switch immediately, circles are rekeyed by
+// their moderator and one on one ledgers ask the other side for a fresh exchange
+func StartKeyRotation(ks *KeyStore, ledgerUUID string) error {
+
+	ledger, _ := GetLedger(ks, ledgerUUID)
+	if ledger == nil {
+		return ErrNotFound
+	}
+
+	if _, ok := ks.LedgerKey(ledgerUUID); !ok {
+		return fmt.Errorf("No Ledger Key for UUID: %s", ledgerUUID)
+	}
+
+	switch ledger.LedgerType {
+	case LEDGER_TYPE_ONEONONE:
+	case LEDGER_TYPE_CIRCLE:
+		return RekeyCircle(ks, ledgerUUID)
+	case LEDGER_TYPE_PUBLIC, LEDGER_TYPE_REQUESTS:
+		return fmt.Errorf("Ledger Type %d can't be rotated", ledger.LedgerType)
+	default:
+		if len(ledger.Users) > 0 {
+			return fmt.Errorf("Ledger %s is shared and can't be rotated", ledgerUUID)
+		}
+
+		// nobody else holds the key so just pick a new one
+		return ks.UpdateLedgerKey(ledgerUUID, func(key *SharedKey) error {
+			*key = key.advance(GeneratePass(), nil)
+			log.Printf("Rotated %s to epoch %d", ledgerUUID, key.Epoch)
+			return nil
+		})
+	}
+
+	priv := GenerateKey()
+	epoch := 0
+	e := ks.UpdateLedgerKey(ledgerUUID, func(key *SharedKey) error {
+		// one already in flight
+		if key.RotationKey != nil {
+			return nil
+		}
+
+		key.RotationKey = MarshalPrivateKey(priv)
+		epoch = key.Epoch + 1
+		return nil
+	})
+	if e != nil || epoch == 0 {
+		return e
+	}
+
+	return writeKeyRotation(ks, ledgerUUID, priv, epoch, false)
+}
+
+// a rotation block showed up on a one on one ledger
+func HandleKeyRotation(ks *KeyStore, ledgerUUID string, author string, kr *KeyRotation) error {
+
+	// we see our own blocks when syncing
+	if author == ks.UUID {
+		return nil
+	}
+
+	if kr.LedgerUUID != ledgerUUID || kr.UUID != author {
+		return fmt.Errorf("KeyRotation for %s from %s doesn't match its block", kr.LedgerUUID, kr.UUID)
+	}
+
+	key, ok := ks.LedgerKey(ledgerUUID)
+	if !ok {
+		return fmt.Errorf("No Ledger Key for UUID: %s", ledgerUUID)
+	}
+
+	// anything other than the next epoch is stale or out of step
+	if kr.Epoch != key.Epoch + 1 {
+		log.Printf("Ignoring KeyRotation to epoch %d while at %d", kr.Epoch, key.Epoch)
+		return nil
+	}
+
+	bKey, e := base64.StdEncoding.DecodeString(kr.PublicKey)
+	if e != nil {
+		return e
+	}
+
+	x, y := elliptic.Unmarshal(elliptic.P521(), bKey)
+	if x == nil {
+		return fmt.Errorf("Invalid KeyRotation Public Key")
+	}
+	peerKey := &ecdsa.PublicKey{Curve: elliptic.P521(), X: x, Y: y}
+
+	if kr.Reply {
+
+		// finish the rotation we started
+		return ks.UpdateLedgerKey(ledgerUUID, func(key *SharedKey) error {
+			if kr.Epoch != key.Epoch + 1 {
+				log.Printf("Ignoring KeyRotation to epoch %d while at %d", kr.Epoch, key.Epoch)
+				return nil
+			}
+
+			if key.RotationKey == nil {
+				return fmt.Errorf("KeyRotation Reply without a Rotation in flight")
+			}
+
+			secret, authKey, e := rotationKeys(UnmarshalPrivateKey(key.RotationKey), peerKey, *key, ledgerUUID, ks.UUID, author)
+			if e != nil {
+				return e
+			}
+
+			*key = key.advance(secret, authKey)
+			log.Printf("Rotated %s to epoch %d", ledgerUUID, kr.Epoch)
+			return nil
+		})
+	}
+
+	// both sides started at once so the lower UUID carries on as the initiator
+	if key.RotationKey != nil && ks.UUID < author {
+		log.Printf("Ignoring KeyRotation from %s in favour of ours", author)
+		return nil
+	}
+
+	priv := GenerateKey()
+
+	secret, authKey, e := rotationKeys(priv, peerKey, key, ledgerUUID, author, ks.UUID)
+	if e != nil {
+		return e
+	}
+
+	// the reply still goes out under the old key since that's all the initiator has
+	if e := writeKeyRotation(ks, ledgerUUID, priv, kr.Epoch, true); e != nil {
+		return e
+	}
+
+	// the secret came from the key as it was so only advance if nothing else has since
+	return ks.UpdateLedgerKey(ledgerUUID, func(current *SharedKey) error {
+		if current.Epoch != key.Epoch {
+			log.Printf("Ignoring KeyRotation to epoch %d while at %d", kr.Epoch, current.Epoch)
+			return nil
+		}
+
+		*current = current.advance(secret, authKey)
+		log.Printf("Rotated %s to epoch %d", ledgerUUID, kr.Epoch)
+		return nil
+	})
+}
+
+// start a rotation when the current epoch has sealed too many blocks or has been
+// in use longer than KeyRotationPeriod
+func maybeRotateLedgerKey(ks *KeyStore, ledgerUUID string) {
+
+	ledger, _ := GetLedger(ks, ledgerUUID)
+	key, ok := ks.LedgerKey(ledgerUUID)
+	if ledger == nil || !ok || key.RotationKey != nil {
+		return
+	}
+
+	if key.Uses >= KeyUseWarning {
+		// the rest wait on whoever can, writes stop at KeyUseLimit until they do
+		if !canRotate(ks, ledger) {
+			log.Printf("Ledger %s has sealed %d of %d blocks allowed under epoch %d and only another user can rekey it", ledgerUUID, key.Uses, KeyUseLimit, key.Epoch)
+			return
+		}
+
+		log.Printf("Ledger %s has sealed %d of %d blocks allowed under epoch %d, rekeying", ledgerUUID, key.Uses, KeyUseLimit, key.Epoch)
+		if e := StartKeyRotation(ks, ledgerUUID); e != nil {
+			log.Printf("Failed to Start KeyRotation for %s: %s", ledgerUUID, e)
+		}
+		return
+	}
+
+	if KeyRotationPeriod <= 0 || ledger.LedgerType != LEDGER_TYPE_ONEONONE {
+		return
+	}
+
+	// keys from before rotation existed start their clock now
+	started, e := time.Parse(TIME_FORMAT, key.EpochStarted)
+	if e != nil {
+		ks.UpdateLedgerKey(ledgerUUID, func(key *SharedKey) error {
+			if _, e := time.Parse(TIME_FORMAT, key.EpochStarted); e != nil {
+				key.EpochStarted = time.Now().UTC().Format(TIME_FORMAT)
+			}
+			return nil
+		})
+		return
+	}
+
+	if time.Since(started) < KeyRotationPeriod {
+		return
+	}
+
+	if e := StartKeyRotation(ks, ledgerUUID); e != nil {
+		log.Printf("Failed to Start KeyRotation for %s: %s", ledgerUUID, e)
+	}
+}
+
+// whether StartKeyRotation can rekey the ledger from our side, the same cases it handles
+func canRotate(ks *KeyStore, ledger *NewLedger) bool {
+
+	switch ledger.LedgerType {
+	case LEDGER_TYPE_ONEONONE:
+		return true
+	case LEDGER_TYPE_CIRCLE:
+		return hasUser(ledger.Moderators, ks.UUID)
+	case LEDGER_TYPE_PUBLIC, LEDGER_TYPE_REQUESTS:
+		return false
+	}
+
+	return len(ledger.Users) == 0
+}
+
+// chain the new epoch off the current secret so the rotation is only as weak as both
+func rotationKeys(priv *ecdsa.PrivateKey, peerKey *ecdsa.PublicKey, key SharedKey, ledgerUUID string, initiator string, responder string) ([]byte, []byte, error) {
+
+	if priv == nil {
+		return nil, nil, fmt.Errorf("Invalid KeyRotation Private Key")
+	}
+
+	shared, e := generateShared(priv, peerKey)
+	if e != nil {
+		return nil, nil, e
+	}
+	defer wipe(shared)
+
+	ctx := KeyContext{Version: key.Epoch + 1, Purpose: KDF_PURPOSE_ROTATION + ":" + ledgerUUID, Initiator: initiator, Responder: responder}
+	return deriveKeys(shared, key.SharedSecret, ctx)
+}
+
+func writeKeyRotation(ks *KeyStore, ledgerUUID string, priv *ecdsa.PrivateKey, epoch int, reply bool) error {
+
+	bKey := elliptic.Marshal(elliptic.P521(), priv.PublicKey.X, priv.PublicKey.Y)
+
+	kr := KeyRotation{UUID: ks.UUID, LedgerUUID: ledgerUUID, PublicKey: base64.StdEncoding.EncodeToString(bKey), Epoch: epoch, Reply: reply}
+	buf, e := json.Marshal(kr)
+	if e != nil {
+		log.Printf("Failed to Marshal KeyRotation: %s", e)
+		return e
+	}
+
+	return WriteBlock(ks, ledgerUUID, KeyRotationType, string(buf))
+}
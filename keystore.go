@@ -2,15 +2,26 @@ package thorne
 
 import (
 
+	"bytes"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/pbkdf2"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 )
 
@@ -21,6 +32,17 @@ const (
 
 )
 
+// keystore files start with the magic, the pbkdf2 iterations as a big endian uint32 and the
+// salt, then the nonce and ciphertext. files without the magic are keyed by sha256 of the password
+const KEYSTORE_MAGIC = "THORNEKS2"
+const KEYSTORE_ITERATIONS = 600000
+const KEYSTORE_SALT_SIZE = 32
+
+var ErrBadPassword 				= errors.New("KeyStore Password is Incorrect")
+var ErrKeyStoreCorrupt 		= errors.New("KeyStore File is Corrupt")
+var ErrNoIdentityKey 			= errors.New("KeyStore holds no Identity Key")
+var ErrNoRSAKey 					= errors.New("KeyStore holds no RSA Key")
+
 type Connection struct {
 
 	Background 							string
@@ -31,6 +53,9 @@ type Connection struct {
 	Name 										string
 	Phone 									string
 	UUID 										string
+	Verified 								bool 					// the user compared safety numbers with them
+	Fingerprint 						string 				// hex of the fingerprint of the keys the connection was made with, or last accepted
+	KeysChanged 						bool 					// their keys changed since Fingerprint was pinned
 
 }
 
@@ -49,6 +74,20 @@ type SharedKey struct {
 	PublicKey 							[]byte
 	SharedSecret 						[]byte
 	Message 								string
+	Version 								int 						// KE_VERSION_* negotiated for a pending connection
+	Verified 								bool 						// the peer's ephemeral key was signed by its identity key
+	Salt 										[]byte 					// key derivation salt exchanged during the handshake
+	AuthKey 								[]byte 					// authentication subkey derived alongside SharedSecret
+	Epoch 									int 						// times the ledger key has been rotated, SharedSecret belongs to this epoch
+	Epochs 									map[int][]byte 	// secrets of earlier epochs kept for reading history
+	EpochStarted 						string 					// when the current epoch began (TIME_FORMAT)
+	RotationKey 						[]byte 					// our ephemeral key while a rotation to Epoch + 1 is in flight
+	Ratchet 								*RatchetState 	// double ratchet for one on one ledgers that opted in
+	Uses 										uint64 					// blocks sealed with the current epoch that we've written or seen
+	KEMPrivateKey 					[]byte 					// our ML-KEM seed while a KE_VERSION_PQ request is pending
+	KEMSecret 							[]byte 					// the secret we encapsulated while a KE_VERSION_PQ response is pending
+	PeerIdentityKey 				string 					// the identity key that vouched for the peer's side of a pending exchange
+	PeerRSAKey 							string 					// the rsa key we encrypted our side of a pending exchange to
 
 }
 
@@ -64,6 +103,31 @@ type KeyStore struct {
 	Ledgers 								[]NewLedger
 	Connections 						[]Connection
 	Metadata 								map[string]string
+	SeenBlocks 							map[string]map[string]string 	// ledger -> blockID -> block date
+	OrgPolicies 						map[string]OrgPolicy 					// approvals a ledger's blocks need before we act on them
+	DeviceID 								string 												// set once this device has a certified subkey
+	DeviceKey 							*ecdsa.PrivateKey 						// signs our blocks in place of the identity key
+	PendingSuccession 			*KeySuccession 								// an identity rotation that hasn't finished
+	PendingIdentityKey 			*ecdsa.PrivateKey 						// the key PendingSuccession hands over to
+
+	// optional custody of the identity and rsa keys outside this process,
+	// when set they are used instead of PrivateKey and RSAKey
+	Signer 									crypto.Signer
+	Decrypter 							crypto.Decrypter
+
+	// optional custody of ledger keys outside this process, when set the
+	// private ledgers we hold no key for are sealed and opened thru it
+	LedgerCipher 						LedgerCipher
+
+	mu 											sync.RWMutex
+
+}
+
+// seals and opens block bodies with ledger keys held somewhere else, an AgentClient is one
+type LedgerCipher interface {
+
+	LedgerEncrypt(ledgerUUID string, blockType string, date string, plaintext []byte) ([]byte, error)
+	LedgerDecrypt(ledgerUUID string, block *NewBlock, body []byte) ([]byte, error)
 
 }
 
@@ -79,6 +143,12 @@ type KeyStoreDisk struct {
 	Ledgers 								[]NewLedger
 	Connections 						[]Connection
 	Metadata 								map[string]string
+	SeenBlocks 							map[string]map[string]string
+	OrgPolicies 						map[string]OrgPolicy
+	DeviceID 								string
+	DeviceKey 							[]byte
+	PendingSuccession 			*KeySuccession
+	PendingIdentityKey 			[]byte
 	
 }
 
@@ -110,12 +180,12 @@ func ReadKeyStore(pass []byte, filename string) (*KeyStore, error) {
 		return nil, e
 	}
 
-	hash := sha256.Sum256(pass)
-	plaintext, e := Decrypt(hash[:], b)
+	plaintext, e := decryptKeyStoreFile(pass, b)
 	if e != nil {
 		log.Printf("Failed to Decrypt: %s", e)
 		return nil, e
 	}
+	defer wipe(plaintext)
 
 	ksd := KeyStoreDisk{}
 	if e := json.Unmarshal(plaintext, &ksd); e != nil {
@@ -123,43 +193,149 @@ func ReadKeyStore(pass []byte, filename string) (*KeyStore, error) {
 		return nil, e
 	}
 
-	ks := &KeyStore{LedgerKeys: ksd.LedgerKeys, UUID: ksd.UUID, PublicUUID: ksd.PublicUUID, PublicUserKey: DecodeKey(ksd.PublicUserKey), PrivateKey: DecodeKey(ksd.PrivateKey), RSAKey: DecodeRSAKey(ksd.RSAKey), Ledgers: ksd.Ledgers, PendingConnections: ksd.PendingConnections, Metadata: ksd.Metadata}
+	return ksd.keyStore(), nil
+}
+
+func (ksd *KeyStoreDisk) keyStore() *KeyStore {
+
+	ks := &KeyStore{LedgerKeys: ksd.LedgerKeys, UUID: ksd.UUID, PublicUUID: ksd.PublicUUID, PublicUserKey: DecodeKey(ksd.PublicUserKey), PrivateKey: DecodeKey(ksd.PrivateKey), RSAKey: DecodeRSAKey(ksd.RSAKey), Ledgers: ksd.Ledgers, PendingConnections: ksd.PendingConnections, Connections: ksd.Connections, Metadata: ksd.Metadata, SeenBlocks: ksd.SeenBlocks, OrgPolicies: ksd.OrgPolicies, DeviceID: ksd.DeviceID, DeviceKey: DecodeKey(ksd.DeviceKey), PendingSuccession: ksd.PendingSuccession, PendingIdentityKey: DecodeKey(ksd.PendingIdentityKey)}
 
 	if ks.PendingConnections == nil {
 		ks.PendingConnections = map[string]SharedKey{}
 	}
 
-	return ks, nil
+	return ks
+}
+
+// callers hold ks.mu
+func (ks *KeyStore) disk() KeyStoreDisk {
+	return KeyStoreDisk{Ledgers: ks.Ledgers, LedgerKeys: ks.LedgerKeys, PrivateKey: EncodeKey(ks.PrivateKey), PublicUserKey: EncodeKey(ks.PublicUserKey), RSAKey: EncodeRSAKey(ks.RSAKey), UUID: ks.UUID, PublicUUID: ks.PublicUUID, PendingConnections: ks.PendingConnections, Connections: ks.Connections, Metadata: ks.Metadata, SeenBlocks: ks.SeenBlocks, OrgPolicies: ks.OrgPolicies, DeviceID: ks.DeviceID, DeviceKey: EncodeKey(ks.DeviceKey), PendingSuccession: ks.PendingSuccession, PendingIdentityKey: EncodeKey(ks.PendingIdentityKey)}
 }
 
 func WriteKeyStore(pass []byte, filename string, ks *KeyStore) error {
 
-	ksd := KeyStoreDisk{Ledgers: ks.Ledgers, LedgerKeys: ks.LedgerKeys, PrivateKey: EncodeKey(ks.PrivateKey), PublicUserKey: EncodeKey(ks.PublicUserKey), RSAKey: EncodeRSAKey(ks.RSAKey), UUID: ks.UUID, PublicUUID: ks.PublicUUID, PendingConnections: ks.PendingConnections, Metadata: ks.Metadata}
-	buf, e := json.Marshal(ksd)
+	ks.mu.RLock()
+	buf, e := json.Marshal(ks.disk())
+	ks.mu.RUnlock()
 	if e != nil {
 		log.Fatalf("Failed to marshal keystore for storage: %s", e)
 	}
+	defer wipe(buf)
+
+	return writeKeyStoreFile(pass, filename, buf)
+}
+
+// verify the old password and write ks under the new one. ks is what's written so a
+// keystore held in memory can't later put back the old password with stale contents,
+// it has to be written with newPass from then on. with no ks the file is re-encrypted
+func ChangePassword(oldPass []byte, newPass []byte, filename string, ks *KeyStore) error {
+
+	b, e := ioutil.ReadFile(filename)
+	if e != nil {
+		log.Printf("Failed to read keystore: %s", e)
+		return e
+	}
+
+	plaintext, e := decryptKeyStoreFile(oldPass, b)
+	if e != nil {
+		log.Printf("Failed to Decrypt with old password: %s", e)
+		return ErrBadPassword
+	}
+	defer wipe(plaintext)
+
+	if ks != nil {
+		return WriteKeyStore(newPass, filename, ks)
+	}
+
+	return writeKeyStoreFile(newPass, filename, plaintext)
+}
+
+// the key a keystore file is sealed with and the nonce and ciphertext that follow it
+func keyStoreFileKey(pass []byte, b []byte) ([]byte, []byte, error) {
+
+	if !bytes.HasPrefix(b, []byte(KEYSTORE_MAGIC)) {
+		hash := sha256.Sum256(pass)
+		return hash[:], b, nil
+	}
+
+	b = b[len(KEYSTORE_MAGIC):]
+	if len(b) < 4 + KEYSTORE_SALT_SIZE {
+		return nil, nil, ErrKeyStoreCorrupt
+	}
+
+	// our own files only ever hold KEYSTORE_ITERATIONS, anything else was tampered with
+	iterations := binary.BigEndian.Uint32(b)
+	if iterations != KEYSTORE_ITERATIONS {
+		return nil, nil, ErrKeyStoreCorrupt
+	}
+
+	key, e := pbkdf2.Key(sha256.New, string(pass), b[4:4 + KEYSTORE_SALT_SIZE], int(iterations), 32)
+	if e != nil {
+		log.Printf("Failed to derive keystore key: %s", e)
+		return nil, nil, e
+	}
+
+	return key, b[4 + KEYSTORE_SALT_SIZE:], nil
+}
+
+func decryptKeyStoreFile(pass []byte, b []byte) ([]byte, error) {
+
+	key, cipherBuf, e := keyStoreFileKey(pass, b)
+	if e != nil {
+		return nil, e
+	}
+	defer wipe(key)
+
+	return Decrypt(key, cipherBuf)
+}
+
+// encrypt and swap the keystore file into place so a failure never leaves a partial file
+func writeKeyStoreFile(pass []byte, filename string, plaintext []byte) error {
+
+	header := make([]byte, len(KEYSTORE_MAGIC) + 4 + KEYSTORE_SALT_SIZE)
+	copy(header, KEYSTORE_MAGIC)
+	binary.BigEndian.PutUint32(header[len(KEYSTORE_MAGIC):], KEYSTORE_ITERATIONS)
+	if _, e := io.ReadFull(rand.Reader, header[len(KEYSTORE_MAGIC) + 4:]); e != nil {
+		log.Printf("Failed to read from crypto/rand: %s", e)
+		return e
+	}
+
+	key, _, e := keyStoreFileKey(pass, header)
+	if e != nil {
+		return e
+	}
+	defer wipe(key)
 
-	hash := sha256.Sum256(pass)
-	cipherBuf, nonce, e := Crypt(hash[:], buf)
+	cipherBuf, nonce, e := Crypt(key, plaintext)
 	if e != nil {
 		log.Printf("Failed to AES Encrypt: %s", e)
 		return e
 	}
 
-	f, e := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	f, e := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename) + ".tmp")
 	if e != nil {
 		log.Printf("Failed to create keystore file: %s", e)
 		return e
 	}
+	defer os.Remove(f.Name())
 
-	if _, e := f.Write(nonce); e != nil {
-		log.Printf("Failed to write nonce to keystore file: %s", e)
+	if e := f.Chmod(0600); e != nil {
+		log.Printf("Failed to set keystore file mode: %s", e)
+		f.Close()
 		return e
 	}
 
-	if _, e := f.Write(cipherBuf); e != nil {
-		log.Printf("Failed to write ciphertext to keystore file: %s", e)
+	for _, v := range [][]byte{header, nonce, cipherBuf} {
+		if _, e := f.Write(v); e != nil {
+			log.Printf("Failed to write keystore file: %s", e)
+			f.Close()
+			return e
+		}
+	}
+
+	if e := f.Sync(); e != nil {
+		log.Printf("Failed to Sync KeyStore File: %s", e)
+		f.Close()
 		return e
 	}
 
@@ -168,10 +344,125 @@ func WriteKeyStore(pass []byte, filename string, ks *KeyStore) error {
 		return e
 	}
 
-	return e
+	if e := os.Rename(f.Name(), filename); e != nil {
+		log.Printf("Failed to replace KeyStore File: %s", e)
+		return e
+	}
+
+	// the rename only survives a crash once the directory is on disk too
+	dir, e := os.Open(filepath.Dir(filename))
+	if e != nil {
+		log.Printf("Failed to open KeyStore Directory: %s", e)
+		return e
+	}
+	defer dir.Close()
+
+	if e := dir.Sync(); e != nil {
+		log.Printf("Failed to Sync KeyStore Directory: %s", e)
+		return e
+	}
+
+	return nil
+}
+
+// the identity key used to sign requests and blocks, nil on a device provisioned without it
+func (ks *KeyStore) IdentitySigner() crypto.Signer {
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	return ks.identitySigner()
+}
+
+// the key our blocks and requests are signed with, the device's own key once it has been certified
+func (ks *KeyStore) BlockSigner() crypto.Signer {
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if ks.signingDevice() != "" {
+		return ks.DeviceKey
+	}
+
+	return ks.identitySigner()
+}
+
+// the device BlockSigner signs as, empty when it's the identity key
+func (ks *KeyStore) SigningDevice() string {
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	return ks.signingDevice()
+}
+
+// what to sign a request or block at version with and the device to name in it, only
+// payloads from SIGNATURE_V2 on name a device so older ones need the identity key
+func (ks *KeyStore) signerFor(version int) (crypto.Signer, string, error) {
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if device := ks.signingDevice(); device != "" && version >= SIGNATURE_V2 {
+		return ks.DeviceKey, device, nil
+	}
+
+	if signer := ks.identitySigner(); signer != nil {
+		return signer, "", nil
+	}
+
+	return nil, "", ErrNoIdentityKey
+}
+
+// the caller holds mu
+func (ks *KeyStore) identitySigner() crypto.Signer {
+
+	if ks.Signer != nil {
+		return ks.Signer
+	}
+
+	if ks.PrivateKey == nil {
+		return nil
+	}
+
+	return ks.PrivateKey
+}
+
+// the caller holds mu
+func (ks *KeyStore) signingDevice() string {
+
+	if ks.DeviceKey != nil && ks.DeviceID != "" {
+		return ks.DeviceID
+	}
+
+	return ""
+}
+
+// the rsa key used to open connection requests
+func (ks *KeyStore) RSADecrypter() crypto.Decrypter {
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if ks.Decrypter != nil {
+		return ks.Decrypter
+	}
+
+	// devices hold no rsa key, and a nil one mustn't come back as a Decrypter that isn't nil
+	if ks.RSAKey == nil {
+		return nil
+	}
+
+	return ks.RSAKey
 }
 
 func EncodeKey(privateKey *ecdsa.PrivateKey) []byte {
+
+    // keys held by a Signer aren't in memory to be written
+    if privateKey == nil {
+        return nil
+    }
+
     x509Encoded, _ := x509.MarshalECPrivateKey(privateKey)
     return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: x509Encoded})
 }
@@ -179,6 +470,9 @@ func EncodeKey(privateKey *ecdsa.PrivateKey) []byte {
 func DecodeKey(pemEncoded []byte) *ecdsa.PrivateKey {
 
     block, _ := pem.Decode(pemEncoded)
+    if block == nil {
+        return nil
+    }
     x509Encoded := block.Bytes
     privateKey, _ := x509.ParseECPrivateKey(x509Encoded)
 
@@ -186,6 +480,11 @@ func DecodeKey(pemEncoded []byte) *ecdsa.PrivateKey {
 }
 
 func EncodeRSAKey(privateKey *rsa.PrivateKey) []byte {
+
+	if privateKey == nil {
+		return nil
+	}
+
 	x509Encoded := x509.MarshalPKCS1PrivateKey(privateKey)
 	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: x509Encoded})
 }
@@ -193,8 +492,245 @@ func EncodeRSAKey(privateKey *rsa.PrivateKey) []byte {
 func DecodeRSAKey(pemEncoded []byte) *rsa.PrivateKey {
 
     block, _ := pem.Decode(pemEncoded)
+    if block == nil {
+        return nil
+    }
     x509Encoded := block.Bytes
     privateKey, _ := x509.ParsePKCS1PrivateKey(x509Encoded)
 
     return privateKey
 }
+
+
+// ******************************************************
+// Guarded access
+// The maps and slices above must only be touched thru these when
+// the keystore is shared between goroutines
+// ******************************************************
+func (ks *KeyStore) AddLedger(ledger NewLedger) {
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	for i, v := range ks.Ledgers {
+		if v.UUID == ledger.UUID {
+			ks.Ledgers[i] = ledger
+			return
+		}
+	}
+
+	ks.Ledgers = append(ks.Ledgers, ledger)
+}
+
+// returns a copy of the ledger so it can be read without holding the lock
+func (ks *KeyStore) Ledger(ledgerUUID string) (NewLedger, bool) {
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	for _, v := range ks.Ledgers {
+		if v.UUID == ledgerUUID {
+			return v, true
+		}
+	}
+
+	return NewLedger{}, false
+}
+
+func (ks *KeyStore) LedgerList() []NewLedger {
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	return append([]NewLedger{}, ks.Ledgers...)
+}
+
+func (ks *KeyStore) SetLastBlock(ledgerUUID string, lastBlock string) {
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	for i, v := range ks.Ledgers {
+		if v.UUID == ledgerUUID {
+			ks.Ledgers[i].LastBlock = lastBlock
+			return
+		}
+	}
+}
+
+func (ks *KeyStore) SetLedgerKey(ledgerUUID string, key SharedKey) {
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.LedgerKeys == nil {
+		ks.LedgerKeys = map[string]SharedKey{}
+	}
+	ks.LedgerKeys[ledgerUUID] = key
+}
+
+func (ks *KeyStore) LedgerKey(ledgerUUID string) (SharedKey, bool) {
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	key, ok := ks.LedgerKeys[ledgerUUID]
+	return key, ok
+}
+
+// read, change and store a ledger key without anyone else touching it in between
+func (ks *KeyStore) UpdateLedgerKey(ledgerUUID string, update func(key *SharedKey) error) error {
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	key, ok := ks.LedgerKeys[ledgerUUID]
+	if !ok {
+		return fmt.Errorf("No Ledger Key for UUID: %s", ledgerUUID)
+	}
+
+	if e := update(&key); e != nil {
+		return e
+	}
+
+	ks.LedgerKeys[ledgerUUID] = key
+	return nil
+}
+
+func (ks *KeyStore) SetPendingConnection(uuid string, key SharedKey) {
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.PendingConnections == nil {
+		ks.PendingConnections = map[string]SharedKey{}
+	}
+	ks.PendingConnections[uuid] = key
+}
+
+func (ks *KeyStore) PendingConnection(uuid string) (SharedKey, bool) {
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	key, ok := ks.PendingConnections[uuid]
+	return key, ok
+}
+
+func (ks *KeyStore) DeletePendingConnection(uuid string) {
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	delete(ks.PendingConnections, uuid)
+}
+
+func (ks *KeyStore) AddConnection(c Connection) {
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	for i, v := range ks.Connections {
+		if v.UUID == c.UUID {
+			ks.Connections[i] = c
+			return
+		}
+	}
+
+	ks.Connections = append(ks.Connections, c)
+}
+
+func (ks *KeyStore) Connection(uuid string) (Connection, bool) {
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	for _, v := range ks.Connections {
+		if v.UUID == uuid {
+			return v, true
+		}
+	}
+
+	return Connection{}, false
+}
+
+func (ks *KeyStore) SetMetadata(key string, value string) {
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.Metadata == nil {
+		ks.Metadata = map[string]string{}
+	}
+	ks.Metadata[key] = value
+}
+
+func (ks *KeyStore) GetMetadata(key string) (string, bool) {
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	v, ok := ks.Metadata[key]
+	return v, ok
+}
+
+func (ks *KeyStore) SetOrgPolicy(ledgerUUID string, policy OrgPolicy) {
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.OrgPolicies == nil {
+		ks.OrgPolicies = map[string]OrgPolicy{}
+	}
+	ks.OrgPolicies[ledgerUUID] = policy
+}
+
+func (ks *KeyStore) OrgPolicy(ledgerUUID string) (OrgPolicy, bool) {
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	p, ok := ks.OrgPolicies[ledgerUUID]
+	return p, ok
+}
+
+func (ks *KeyStore) BlockSeen(ledgerUUID string, id string) bool {
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	_, ok := ks.SeenBlocks[ledgerUUID][id]
+	return ok
+}
+
+// record a block by its blockID, false when it was already seen. entries older
+// than ReplayWindow are dropped since blocks that old aren't acted on anyway
+func (ks *KeyStore) MarkBlockSeen(ledgerUUID string, id string, date time.Time) bool {
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.SeenBlocks == nil {
+		ks.SeenBlocks = map[string]map[string]string{}
+	}
+
+	seen := ks.SeenBlocks[ledgerUUID]
+	if seen == nil {
+		seen = map[string]string{}
+		ks.SeenBlocks[ledgerUUID] = seen
+	}
+
+	if _, ok := seen[id]; ok {
+		return false
+	}
+
+	cutoff := time.Now().Add(-ReplayWindow)
+	for k, v := range seen {
+		if t, e := time.Parse(time.RFC3339, v); e != nil || t.Before(cutoff) {
+			delete(seen, k)
+		}
+	}
+
+	seen[id] = date.UTC().Format(time.RFC3339)
+	return true
+}
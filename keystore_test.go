@@ -0,0 +1,91 @@
+package thorne
+
+import (
+
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+)
+
+// run with -race, every goroutine shares the one keystore
+func TestKeyStoreConcurrentAccess(t *testing.T) {
+
+	ks := &KeyStore{UUID: "owner", PrivateKey: GenerateKey(), PublicUserKey: GenerateKey()}
+	ks.RSAKey, _ = rsaGenerateKey()
+
+	pass := []byte("password")
+	filename := filepath.Join(t.TempDir(), "keystore")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			uuid := fmt.Sprintf("ledger-%d", i % 4)
+			ks.AddLedger(NewLedger{UUID: uuid, LedgerType: LEDGER_TYPE_PRIVATE})
+			ks.SetLastBlock(uuid, fmt.Sprintf("block-%d", i))
+			GetLedger(ks, uuid)
+			ks.LedgerList()
+
+			ks.SetLedgerKey(uuid, SharedKey{Epoch: 1})
+			ks.UpdateLedgerKey(uuid, func(key *SharedKey) error {
+				key.Uses++
+				return nil
+			})
+			ks.LedgerKey(uuid)
+
+			ks.SetPendingConnection(uuid, SharedKey{})
+			ks.PendingConnection(uuid)
+			ks.DeletePendingConnection(uuid)
+
+			ks.AddConnection(Connection{UUID: uuid})
+			ks.Connection(uuid)
+
+			ks.SetMetadata(uuid, uuid)
+			ks.GetMetadata(uuid)
+
+			id := fmt.Sprintf("%d", i)
+			ks.MarkBlockSeen(uuid, id, time.Now())
+			ks.BlockSeen(uuid, id)
+
+			if _, _, e := ks.signerFor(SignatureVersion); e != nil {
+				t.Error(e)
+			}
+
+			// deriving the file key is slow on purpose so only a few write
+			if i % 8 == 0 {
+				if e := WriteKeyStore(pass, filename, ks); e != nil {
+					t.Error(e)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := len(ks.LedgerList()); n != 4 {
+		t.Fatalf("Expected 4 Ledgers, have %d", n)
+	}
+
+	for _, v := range ks.LedgerList() {
+		if key, _ := ks.LedgerKey(v.UUID); key.Uses == 0 {
+			t.Fatalf("Lost the Uses of %s", v.UUID)
+		}
+	}
+
+	if e := WriteKeyStore(pass, filename, ks); e != nil {
+		t.Fatal(e)
+	}
+
+	rks, e := ReadKeyStore(pass, filename)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if len(rks.LedgerList()) != 4 {
+		t.Fatalf("Expected 4 Ledgers on disk, have %d", len(rks.LedgerList()))
+	}
+}
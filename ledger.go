@@ -1,5 +1,11 @@
 package thorne
 
+import (
+
+  "time"
+
+)
+
 const (
 
   LEDGER_TYPE_PRIVATE     = iota
@@ -68,6 +74,7 @@ type PublicProfileResponse struct {
 type LedgerBlockRequest struct {
 
   Signature               string
+  SignatureVersion        int           // how the signature was made, see SIGNATURE_V2
   LedgerLastBlock         LedgerLastBlock
 
 }
@@ -77,17 +84,19 @@ type LedgerLastBlock struct {
   UUID                    string        // UUID of the user creating the ledger
   Date                    string        // timestamp to increase entropy and prevent replay attacks
   LedgerUUID              string
+  Device                  string        // DeviceID when a device signed instead of the identity key
 
 }
 
 type LedgerRequest struct {
 
   Signature               string
+  SignatureVersion        int           // how the signature was made, see SIGNATURE_V2
   LedgerBlock             LedgerBlock
 
 }
 
-// this must be in alphabetical order for the signatures to match
+// v1 signatures only covered UUID, LedgerType and Date, v2 covers every field
 type LedgerBlock struct {
 
   AdditionalUsers         []string
@@ -98,6 +107,7 @@ type LedgerBlock struct {
   Site                    string
   Description             string
   HasIcon                 bool
+  Device                  string        // DeviceID when a device signed instead of the identity key
 
 }
 
@@ -140,6 +150,7 @@ type NewBlock struct {
   Date                  string            // the date the block was created (provided by app)
   Attachments           []BlockAttachment // any block attachments like files
   BlockType             string
+  Device                string            // the author's device that signed the block, empty for the identity key
 
 }
 
@@ -149,8 +160,20 @@ type BlockRequest struct {
   UID                   string            // UUID for the Block (generated by vaipor)
   Block                 NewBlock          // The Block Contents Submitted by the user
   Signature             string            // The User's Signature for the Block
+  SignatureVersion      int               // how the signature was made, see SIGNATURE_V2
   OrgSignatures         []OrganizationalSignatures
+  seen                  time.Time         // the latest it could have been written, when it was fetched or the date of a verified block after it
+
+}
+
+// when the block was first seen, now for one we haven't fetched
+func (br *BlockRequest) seenBy() time.Time {
+
+  if br.seen.IsZero() {
+    return time.Now()
+  }
 
+  return br.seen
 }
 
 // Signatures that provide additional verification of authority on top of the author's
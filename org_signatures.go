@@ -0,0 +1,140 @@
+package thorne
+
+import (
+
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+)
+
+// ******************************************************
+// Organizational Signatures
+// An organization co-signs a prepared block to approve it and readers
+// can insist a ledger's blocks carry enough of those approvals
+// ******************************************************
+
+// blocks on a ledger need Required valid signatures from the organizations in Orgs
+type OrgPolicy struct {
+
+	Orgs 										[]string 			// UUIDs of the organizations that may approve
+	Required 								int 					// how many of them have to
+
+}
+
+var ErrOrgPolicy 					= errors.New("Block doesn't meet the Ledger's Organizational Policy")
+
+// what an organization signs, the author's own payload bound to the organization
+func orgSigningPayload(orgUUID string, br *BlockRequest) ([]byte, error) {
+
+	if br.SignatureVersion < SIGNATURE_V2 {
+		return nil, fmt.Errorf("Blocks signed with version %d can't be co-signed", br.SignatureVersion)
+	}
+
+	payload, e := blockSigningPayload(br.SignatureVersion, br)
+	if e != nil {
+		return nil, e
+	}
+
+	return encodeFields([]byte("thorne/sig/org"), []byte(orgUUID), []byte(strconv.Itoa(br.SignatureVersion)), payload), nil
+}
+
+// approve a block as the organization org, the author's signature has to check out first
+func CoSignBlock(org *KeyStore, br *BlockRequest) error {
+
+	if !VerifyBlockSignature(br) {
+		return fmt.Errorf("Failed to verify signature from author: %s", br.Block.UUID)
+	}
+
+	payload, e := orgSigningPayload(org.UUID, br)
+	if e != nil {
+		return e
+	}
+
+	if org.IdentitySigner() == nil {
+		return ErrNoIdentityKey
+	}
+
+	sig, e := GenerateSignature(org.IdentitySigner(), payload)
+	if e != nil {
+		return e
+	}
+	signature := base64.StdEncoding.EncodeToString(sig)
+
+	// signing again replaces the earlier one
+	for i, v := range br.OrgSignatures {
+		if v.UUID == org.UUID {
+			br.OrgSignatures[i].Signature = signature
+			return nil
+		}
+	}
+
+	br.OrgSignatures = append(br.OrgSignatures, OrganizationalSignatures{UUID: org.UUID, Signature: signature})
+	return nil
+}
+
+// check the organizational signatures on a block and return the organizations whose signature
+// verified, ones that don't are skipped so a bad entry can't hide the good ones
+func VerifyOrgSignatures(br *BlockRequest) ([]string, error) {
+
+	signers := []string{}
+	for _, v := range br.OrgSignatures {
+		signers = append(signers, v.UUID)
+	}
+
+	return verifyOrgSignatures(br, signers)
+}
+
+// only organizations in allowed are looked at, anyone can add entries to a block
+// and each one costs a key fetch
+func verifyOrgSignatures(br *BlockRequest, allowed []string) ([]string, error) {
+
+	orgs := []string{}
+	for _, v := range br.OrgSignatures {
+
+		if hasUser(orgs, v.UUID) || !hasUser(allowed, v.UUID) {
+			continue
+		}
+
+		payload, e := orgSigningPayload(v.UUID, br)
+		if e != nil {
+			return orgs, e
+		}
+
+		key, e := PublicKeyAt(v.UUID, br.Block.Date, br.seenBy())
+		if e == nil {
+			e = checkIdentityRevocation(v.UUID, key, br.Block.Date, br.seenBy())
+		}
+
+		if e != nil || !VerifySignature(key, v.Signature, payload) {
+			log.Printf("Skipping Organizational Signature from %s that doesn't verify", v.UUID)
+			continue
+		}
+
+		orgs = append(orgs, v.UUID)
+	}
+
+	return orgs, nil
+}
+
+// whether a block carries the approvals policy asks for
+func (p OrgPolicy) Check(br *BlockRequest) error {
+
+	if p.Required <= 0 {
+		return nil
+	}
+
+	orgs, e := verifyOrgSignatures(br, p.Orgs)
+	if e != nil {
+		return e
+	}
+
+	if len(orgs) < p.Required {
+		log.Printf("Block from %s has %d of %d required Organizational Signatures", br.Block.UUID, len(orgs), p.Required)
+		return ErrOrgPolicy
+	}
+
+	return nil
+}
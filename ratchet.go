@@ -0,0 +1,540 @@
+package thorne
+
+import (
+
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"golang.org/x/crypto/hkdf"
+
+)
+
+// ******************************************************
+// Double Ratchet
+// Opt in forward secrecy for one on one ledgers, every block
+// moves a symmetric chain along and every reply brings a new
+// DH ratchet so a stolen key only exposes a short window
+// ******************************************************
+const RatchetInitType = "dr0"
+type RatchetInit struct {
+
+	UUID 								string 				// UUID of the side turning the ratchet on
+	LedgerUUID 					string
+	PublicKey 					string 				// first X25519 ratchet key of the sender
+
+}
+
+func UnmarshalRatchetInit(buf []byte) (*RatchetInit, error) {
+	kei := &RatchetInit{}
+	e := json.Unmarshal(buf, kei)
+	return kei, e
+}
+
+// marks a body sealed with a ratchet message key, followed by the header
+const BLOCK_CIPHER_RATCHET = "\x00TR1"
+
+// most message keys we'll derive ahead of time for blocks that haven't arrived yet
+const RATCHET_MAX_SKIP = 1000
+
+// most of our own message keys kept so our side of the history can be read again,
+// anything older is as gone as it would be without the ratchet
+const RATCHET_MAX_SENT = 1000
+
+const KDF_PURPOSE_RATCHET = "ledger-ratchet"
+
+var ErrRatchetNotReady 		= errors.New("Ratchet has not received a key from the other side yet")
+var ErrRatchetSkip 				= errors.New("Too many skipped ratchet messages")
+var ErrRatchetDevice 			= errors.New("Only the KeyStore holding the Identity Key can Ratchet")
+
+type RatchetState struct {
+
+	DHSelf 									[]byte 					// our current X25519 ratchet private key
+	DHRemote 								[]byte 					// their current X25519 ratchet public key
+	RootKey 								[]byte
+	SendChain 							[]byte 					// nil until we've heard from the other side
+	RecvChain 							[]byte
+	SendN 									uint32 					// messages sent on the current sending chain
+	RecvN 									uint32 					// messages received on the current receiving chain
+	PrevN 									uint32 					// length of our previous sending chain
+	Skipped 								map[string][]byte 		// message keys for blocks we haven't seen yet
+	SkippedOrder 						[]string 				// keys of Skipped oldest first
+	Sent 										map[string][]byte 		// message keys of our own recent blocks
+	SentOrder 							[]string 				// keys of Sent oldest first
+
+}
+
+// header in front of every ratchet body, it is authenticated along with the block
+type ratchetHeader struct {
+
+	DH 											[]byte
+	PN 											uint32
+	N 											uint32
+
+}
+
+// the ratchet moves on with every block so only one copy of its state can exist. that's the
+// keystore holding the identity key, devices provisioned without it can't read or write
+// ratcheted blocks
+func ownsRatchet(ks *KeyStore) bool {
+	return ks.IdentitySigner() != nil
+}
+
+// turn the ratchet on for a one on one ledger, the other side starts sending with it once
+// they see our key and we follow as soon as their first ratcheted block arrives
+func EnableRatchet(ks *KeyStore, ledgerUUID string) error {
+
+	if !ownsRatchet(ks) {
+		return ErrRatchetDevice
+	}
+
+	ledger, _ := GetLedger(ks, ledgerUUID)
+	if ledger == nil {
+		return ErrNotFound
+	}
+
+	if ledger.LedgerType != LEDGER_TYPE_ONEONONE {
+		return fmt.Errorf("Only one on one ledgers can ratchet")
+	}
+
+	priv, e := ecdh.X25519().GenerateKey(rand.Reader)
+	if e != nil {
+		log.Printf("Failed to generate ratchet key: %s", e)
+		return e
+	}
+
+	e = ks.UpdateLedgerKey(ledgerUUID, func(key *SharedKey) error {
+
+		if key.Ratchet != nil {
+			return fmt.Errorf("Ratchet is already enabled for %s", ledgerUUID)
+		}
+
+		rootKey, _, e := ratchetRootKey(key.SharedSecret, ledgerUUID, ks.UUID)
+		if e != nil {
+			return e
+		}
+
+		key.Ratchet = &RatchetState{DHSelf: priv.Bytes(), RootKey: rootKey, Skipped: map[string][]byte{}}
+		return nil
+	})
+
+	if e != nil {
+		return e
+	}
+
+	ri := RatchetInit{UUID: ks.UUID, LedgerUUID: ledgerUUID, PublicKey: base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes())}
+	buf, e := json.Marshal(ri)
+	if e != nil {
+		log.Printf("Failed to Marshal RatchetInit: %s", e)
+		return e
+	}
+
+	return WriteBlock(ks, ledgerUUID, RatchetInitType, string(buf))
+}
+
+// the other side turned the ratchet on so take the first DH step and start sending
+func HandleRatchetInit(ks *KeyStore, ledgerUUID string, author string, ri *RatchetInit) error {
+
+	// we see our own blocks when syncing
+	if author == ks.UUID {
+		return nil
+	}
+
+	if ri.LedgerUUID != ledgerUUID || ri.UUID != author {
+		return fmt.Errorf("RatchetInit for %s from %s doesn't match its block", ri.LedgerUUID, ri.UUID)
+	}
+
+	remote, e := base64.StdEncoding.DecodeString(ri.PublicKey)
+	if e != nil {
+		return e
+	}
+
+	remoteKey, e := ecdh.X25519().NewPublicKey(remote)
+	if e != nil {
+		return e
+	}
+
+	own := ownsRatchet(ks)
+
+	return ks.UpdateLedgerKey(ledgerUUID, func(key *SharedKey) error {
+
+		// a device only notes the ledger ratchets so it doesn't write to it under the ledger key
+		if !own {
+			if key.Ratchet == nil {
+				key.Ratchet = &RatchetState{}
+			}
+			return nil
+		}
+
+		if key.Ratchet != nil {
+
+			// both sides turned it on at once so the lower UUID keeps its key
+			if key.Ratchet.SendChain == nil && key.Ratchet.DHRemote == nil && ks.UUID < author {
+				log.Printf("Ignoring RatchetInit from %s in favour of ours", author)
+				return nil
+			}
+
+			if key.Ratchet.DHRemote != nil {
+				log.Printf("Ignoring RatchetInit from %s, already ratcheting", author)
+				return nil
+			}
+		}
+
+		rootKey, _, e := ratchetRootKey(key.SharedSecret, ledgerUUID, author)
+		if e != nil {
+			return e
+		}
+
+		priv, e := ecdh.X25519().GenerateKey(rand.Reader)
+		if e != nil {
+			return e
+		}
+
+		rs := &RatchetState{DHSelf: priv.Bytes(), DHRemote: remote, RootKey: rootKey, Skipped: map[string][]byte{}}
+
+		dh, e := priv.ECDH(remoteKey)
+		if e != nil {
+			return e
+		}
+
+		if rs.RootKey, rs.SendChain, e = ratchetKDFRoot(rs.RootKey, dh); e != nil {
+			return e
+		}
+
+		key.Ratchet = rs
+		return nil
+	})
+}
+
+// seal a block body with the next message key of the sending chain. the chain moves on here so
+// two writes never share a key, release steps it back if the block never reached the API
+func ratchetSealBlock(ks *KeyStore, ledgerUUID string, blockType string, date string, plaintext []byte) ([]byte, func(), error) {
+
+	if !ownsRatchet(ks) {
+		return nil, nil, ErrRatchetDevice
+	}
+
+	var body []byte
+	var prev, next *RatchetState
+
+	e := ks.UpdateLedgerKey(ledgerUUID, func(key *SharedKey) error {
+
+		if key.Ratchet == nil || key.Ratchet.SendChain == nil {
+			return ErrRatchetNotReady
+		}
+		prev = key.Ratchet
+		rs := key.Ratchet.clone()
+
+		priv, e := ecdh.X25519().NewPrivateKey(rs.DHSelf)
+		if e != nil {
+			return e
+		}
+
+		h := ratchetHeader{DH: priv.PublicKey().Bytes(), PN: rs.PrevN, N: rs.SendN}
+		header := h.marshal()
+
+		var mk []byte
+		rs.SendChain, mk = ratchetKDFChain(rs.SendChain)
+		rs.SendN++
+		rs.remember(&rs.Sent, &rs.SentOrder, skippedKey(h.DH, h.N), append([]byte{}, mk...), RATCHET_MAX_SENT)
+		defer wipe(mk)
+
+		cipher, nonce, e := CryptWithData(mk, plaintext, append(blockAssociatedData(ledgerUUID, ks.UUID, blockType, date, 0), header...))
+		if e != nil {
+			return e
+		}
+
+		body = append([]byte(BLOCK_CIPHER_RATCHET), header...)
+		body = append(body, nonce...)
+		body = append(body, cipher...)
+
+		key.Ratchet = rs
+		next = rs
+		return nil
+	})
+
+	if e != nil {
+		return nil, nil, e
+	}
+
+	release := func() {
+		ks.UpdateLedgerKey(ledgerUUID, func(key *SharedKey) error {
+			// anything sealed or read since depends on where the chain is now
+			if key.Ratchet == next {
+				key.Ratchet = prev
+			}
+			return nil
+		})
+	}
+
+	return body, release, nil
+}
+
+// open a ratcheted body, stepping the receiving chain and DH ratchet as needed
+func ratchetOpenBlock(ks *KeyStore, ledgerUUID string, block *NewBlock, body []byte) ([]byte, error) {
+
+	if !ownsRatchet(ks) {
+		return nil, ErrRatchetDevice
+	}
+
+	body = body[len(BLOCK_CIPHER_RATCHET):]
+	h, e := unmarshalRatchetHeader(body)
+	if e != nil {
+		return nil, e
+	}
+	header := body[:ratchetHeaderSize]
+	cipher := body[ratchetHeaderSize:]
+	ad := append(blockAssociatedData(ledgerUUID, block.UUID, block.BlockType, block.Date, 0), header...)
+
+	var plaintext []byte
+	e = ks.UpdateLedgerKey(ledgerUUID, func(key *SharedKey) error {
+
+		rs := key.Ratchet
+		if rs == nil {
+			return fmt.Errorf("Ratchet isn't enabled for %s", ledgerUUID)
+		}
+
+		// ours were sealed with keys we kept, reading them doesn't move the ratchet
+		if block.UUID == ks.UUID {
+			mk, ok := rs.Sent[skippedKey(h.DH, h.N)]
+			if !ok {
+				return fmt.Errorf("Message Key of our Ratchet Block is gone")
+			}
+
+			var e error
+			plaintext, e = DecryptWithData(mk, cipher, ad)
+			return e
+		}
+
+		// work on a copy so a forged block can't knock the ratchet out of step
+		next := rs.clone()
+
+		mk, e := next.messageKey(h)
+		if e != nil {
+			return e
+		}
+		defer wipe(mk)
+
+		if plaintext, e = DecryptWithData(mk, cipher, ad); e != nil {
+			return e
+		}
+
+		key.Ratchet = next
+		return nil
+	})
+
+	return plaintext, e
+}
+
+// find or derive the key for the message with header h
+func (rs *RatchetState) messageKey(h *ratchetHeader) ([]byte, error) {
+
+	if mk, ok := rs.Skipped[skippedKey(h.DH, h.N)]; ok {
+		rs.forget(&rs.Skipped, &rs.SkippedOrder, skippedKey(h.DH, h.N))
+		return mk, nil
+	}
+
+	if !bytes.Equal(h.DH, rs.DHRemote) {
+
+		if e := rs.skip(h.PN); e != nil {
+			return nil, e
+		}
+
+		if e := rs.dhRatchet(h.DH); e != nil {
+			return nil, e
+		}
+
+	}
+
+	if e := rs.skip(h.N); e != nil {
+		return nil, e
+	}
+
+	var mk []byte
+	rs.RecvChain, mk = ratchetKDFChain(rs.RecvChain)
+	rs.RecvN++
+
+	return mk, nil
+}
+
+// keep the keys of messages before until so they can still be read when they turn up
+func (rs *RatchetState) skip(until uint32) error {
+
+	if rs.RecvChain == nil {
+		return nil
+	}
+
+	if until < rs.RecvN {
+		return nil
+	}
+
+	if until - rs.RecvN > RATCHET_MAX_SKIP {
+		return ErrRatchetSkip
+	}
+
+	// the oldest skipped keys make way, those blocks are most likely lost for good
+	for rs.RecvN < until {
+		var mk []byte
+		rs.RecvChain, mk = ratchetKDFChain(rs.RecvChain)
+		rs.remember(&rs.Skipped, &rs.SkippedOrder, skippedKey(rs.DHRemote, rs.RecvN), mk, RATCHET_MAX_SKIP)
+		rs.RecvN++
+	}
+
+	return nil
+}
+
+// keep a message key, dropping the oldest past max
+func (rs *RatchetState) remember(keys *map[string][]byte, order *[]string, id string, mk []byte, max int) {
+
+	if *keys == nil {
+		*keys = map[string][]byte{}
+	}
+
+	(*keys)[id] = mk
+	*order = append(*order, id)
+
+	for len(*order) > max {
+		if old, ok := (*keys)[(*order)[0]]; ok {
+			wipe(old)
+			delete(*keys, (*order)[0])
+		}
+		*order = (*order)[1:]
+	}
+}
+
+func (rs *RatchetState) forget(keys *map[string][]byte, order *[]string, id string) {
+
+	delete(*keys, id)
+	for i, v := range *order {
+		if v == id {
+			*order = append((*order)[:i:i], (*order)[i + 1:]...)
+			break
+		}
+	}
+}
+
+func (rs *RatchetState) dhRatchet(remote []byte) error {
+
+	remoteKey, e := ecdh.X25519().NewPublicKey(remote)
+	if e != nil {
+		return e
+	}
+
+	priv, e := ecdh.X25519().NewPrivateKey(rs.DHSelf)
+	if e != nil {
+		return e
+	}
+
+	dh, e := priv.ECDH(remoteKey)
+	if e != nil {
+		return e
+	}
+
+	if rs.RootKey, rs.RecvChain, e = ratchetKDFRoot(rs.RootKey, dh); e != nil {
+		return e
+	}
+
+	priv, e = ecdh.X25519().GenerateKey(rand.Reader)
+	if e != nil {
+		return e
+	}
+
+	if dh, e = priv.ECDH(remoteKey); e != nil {
+		return e
+	}
+
+	if rs.RootKey, rs.SendChain, e = ratchetKDFRoot(rs.RootKey, dh); e != nil {
+		return e
+	}
+
+	rs.PrevN = rs.SendN
+	rs.SendN = 0
+	rs.RecvN = 0
+	rs.DHSelf = priv.Bytes()
+	rs.DHRemote = remote
+
+	return nil
+}
+
+func (rs *RatchetState) clone() *RatchetState {
+
+	c := *rs
+	c.Skipped = map[string][]byte{}
+	for k, v := range rs.Skipped {
+		c.Skipped[k] = append([]byte{}, v...)
+	}
+
+	c.Sent = map[string][]byte{}
+	for k, v := range rs.Sent {
+		c.Sent[k] = append([]byte{}, v...)
+	}
+
+	c.SkippedOrder = append([]string{}, rs.SkippedOrder...)
+	c.SentOrder = append([]string{}, rs.SentOrder...)
+
+	return &c
+}
+
+// both sides start from the ledger key bound to whoever turned the ratchet on
+func ratchetRootKey(secret []byte, ledgerUUID string, enabler string) ([]byte, []byte, error) {
+	return deriveKeys(secret, []byte("thorne/ratchet"), KeyContext{Purpose: KDF_PURPOSE_RATCHET + ":" + ledgerUUID, Initiator: enabler})
+}
+
+func ratchetKDFRoot(rootKey []byte, dh []byte) ([]byte, []byte, error) {
+
+	kdf := hkdf.New(sha256.New, dh, rootKey, []byte("thorne/ratchet/root"))
+
+	k := make([]byte, 64)
+	if _, e := io.ReadFull(kdf, k); e != nil {
+		log.Printf("Failed to read from HKDF: %s", e)
+		return nil, nil, e
+	}
+
+	return k[:32], k[32:], nil
+}
+
+// next chain key and the message key for this step
+func ratchetKDFChain(chainKey []byte) ([]byte, []byte) {
+
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{1})
+	mk := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{2})
+
+	return mac.Sum(nil), mk
+}
+
+func skippedKey(dh []byte, n uint32) string {
+	return fmt.Sprintf("%s:%d", base64.StdEncoding.EncodeToString(dh), n)
+}
+
+const ratchetHeaderSize = 32 + 4 + 4
+
+func (h *ratchetHeader) marshal() []byte {
+
+	buf := append([]byte{}, h.DH...)
+	buf = binary.BigEndian.AppendUint32(buf, h.PN)
+	buf = binary.BigEndian.AppendUint32(buf, h.N)
+
+	return buf
+}
+
+func unmarshalRatchetHeader(buf []byte) (*ratchetHeader, error) {
+
+	if len(buf) < ratchetHeaderSize + 12 {
+		return nil, fmt.Errorf("Ratchet block is too short")
+	}
+
+	return &ratchetHeader{DH: append([]byte{}, buf[:32]...), PN: binary.BigEndian.Uint32(buf[32:36]), N: binary.BigEndian.Uint32(buf[36:40])}, nil
+}
@@ -0,0 +1,412 @@
+package thorne
+
+import (
+
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+)
+
+// ******************************************************
+// Streaming Reads
+// The other side of WriteBlockStream, a block's contents are spooled
+// to a temporary file and hashed as they're fetched so the block is
+// verified and opened without ever being held in memory
+// ******************************************************
+
+// most of a block besides its contents we'll hold while reading it
+const BLOCK_STREAM_MAX_ENVELOPE = 1024 * 1024
+
+var ErrBlockEnvelope 			= errors.New("Block is not in the expected Form")
+
+type BlockStream struct {
+
+	Block 									*BlockRequest 		// everything but Block.Contents, which stays on disk
+	contents 								*os.File 					// the contents as base64, the way the API sent them
+
+}
+
+// fetch and verify a block like GetBlock, Close removes the spooled contents
+func GetBlockStream(blockURL string) (*BlockStream, error) {
+	return getBlockStream(blockURL, time.Now())
+}
+
+// seen is the latest the block can have been written
+func getBlockStream(blockURL string, seen time.Time) (*BlockStream, error) {
+
+	x, e := http.Get(blockURL)
+	if e != nil {
+		log.Printf("Failed to Fetch Block: %s", e)
+		return nil, e
+	}
+	defer x.Body.Close()
+
+	if x.StatusCode != 200 {
+		return nil, fmt.Errorf("Failed to fetch block: %d", x.StatusCode)
+	}
+
+	f, e := ioutil.TempFile("", "thorne-block")
+	if e != nil {
+		log.Printf("Failed to create Block File: %s", e)
+		return nil, e
+	}
+
+	bs := &BlockStream{contents: f}
+	if e := bs.spool(x.Body, seen); e != nil {
+		bs.Close()
+		return nil, e
+	}
+
+	return bs, nil
+}
+
+func (bs *BlockStream) spool(r io.Reader, seen time.Time) error {
+
+	// v2 on signs the digest of the contents so that's taken on the way thru
+	hash := sha256.New()
+	envelope, e := scanBlockJSON(bufio.NewReader(r), io.MultiWriter(bs.contents, hash), BLOCK_STREAM_MAX_ENVELOPE)
+	if e != nil {
+		log.Printf("Failed to read Block: %s", e)
+		return e
+	}
+
+	br := &BlockRequest{seen: seen}
+	if e := json.Unmarshal(envelope, br); e != nil {
+		log.Printf("Failed to Unmarshal Block: %s", e)
+		return e
+	}
+	br.Block.Contents = ""
+	bs.Block = br
+
+	if br.SignatureVersion < MinSignatureVersion {
+		log.Printf("Block from %s signed with retired version %d", br.Block.UUID, br.SignatureVersion)
+		return ErrSignatureVersion
+	}
+
+	digest, e := bs.signingDigest(hash.Sum(nil))
+	if e != nil {
+		return e
+	}
+
+	if e := verifyBlockDigest(br, digest); e != nil {
+		log.Printf("Failed to verify signature with publicKey: %s: %s", br.Block.UUID, e)
+		return e
+	}
+
+	return nil
+}
+
+// the digest of the block's signing payload, contentsDigest is the sha256 of the spooled contents
+func (bs *BlockStream) signingDigest(contentsDigest []byte) ([]byte, error) {
+
+	br := bs.Block
+	switch br.SignatureVersion {
+	case SIGNATURE_V1:
+		// v1 signs the contents themselves between the other fields so they're read back
+		h := sha256.New()
+		h.Write([]byte(br.Block.UUID + br.Block.Ledger))
+		if _, e := bs.contents.Seek(0, io.SeekStart); e != nil {
+			return nil, e
+		}
+		if _, e := io.Copy(h, bs.contents); e != nil {
+			return nil, e
+		}
+		h.Write([]byte(br.Block.Date + br.Block.BlockType))
+		return h.Sum(nil), nil
+	case SIGNATURE_V2, SIGNATURE_V3:
+		digest := sha256.Sum256(blockSigningFields(br.SignatureVersion, br, contentsDigest))
+		return digest[:], nil
+	}
+
+	return nil, ErrSignatureVersion
+}
+
+// the block's contents as they were written, still sealed on private ledgers
+func (bs *BlockStream) Contents() (io.Reader, error) {
+
+	if _, e := bs.contents.Seek(0, io.SeekStart); e != nil {
+		return nil, e
+	}
+
+	return base64.NewDecoder(base64.StdEncoding, bs.contents), nil
+}
+
+// decrypt the contents. streamed bodies are opened as they're read and like any stream are
+// only whole once the reader returns io.EOF, bodies sealed in one piece are opened in one
+func (bs *BlockStream) Open(ks *KeyStore, ledger *NewLedger) (io.Reader, error) {
+
+	r, e := bs.Contents()
+	if e != nil {
+		return nil, e
+	}
+
+	if ledger.LedgerType == LEDGER_TYPE_PUBLIC || ledger.LedgerType == LEDGER_TYPE_REQUESTS {
+		return r, nil
+	}
+
+	br := bufio.NewReader(r)
+	key, ok := ks.LedgerKey(ledger.UUID)
+
+	if prefix, _ := br.Peek(len(BLOCK_CIPHER_STREAM) + 4); bytes.HasPrefix(prefix, []byte(BLOCK_CIPHER_STREAM)) && (ok || ks.LedgerCipher == nil) {
+		// counted as it's opened since a stream is only known to be whole at its end,
+		// our own writes were counted when we sealed them
+		if bs.Block.Block.UUID != ks.UUID {
+			countKeyUse(ks, ledger.UUID, blockEpoch(prefix))
+		}
+		return OpenBlockStream(br, key, ledger.UUID, &bs.Block.Block)
+	}
+
+	body, e := ioutil.ReadAll(br)
+	if e != nil {
+		return nil, e
+	}
+
+	var b []byte
+	if bytes.HasPrefix(body, []byte(BLOCK_CIPHER_RATCHET)) {
+		b, e = ratchetOpenBlock(ks, ledger.UUID, &bs.Block.Block, body)
+	} else if !ok && ks.LedgerCipher != nil {
+		// the cipher only takes whole bodies, streamed ones included
+		b, e = ks.LedgerCipher.LedgerDecrypt(ledger.UUID, &bs.Block.Block, body)
+	} else {
+		b, e = OpenBlock(key, ledger.UUID, &bs.Block.Block, body)
+
+		if e == nil && bs.Block.Block.UUID != ks.UUID {
+			countKeyUse(ks, ledger.UUID, blockEpoch(body))
+		}
+	}
+
+	if e != nil {
+		return nil, e
+	}
+
+	return bytes.NewReader(b), nil
+}
+
+func (bs *BlockStream) Close() error {
+
+	bs.contents.Close()
+	return os.Remove(bs.contents.Name())
+}
+
+// copy a block's JSON with Block.Contents emptied, the contents go to w as they're read.
+// everything else has to fit in max
+func scanBlockJSON(r *bufio.Reader, w io.Writer, max int) ([]byte, error) {
+
+	type frame struct {
+
+		object 									bool
+		key 										string 				// the key whose value is being read
+		expectKey 							bool
+
+	}
+
+	var out bytes.Buffer
+	stack := []frame{}
+	found := false
+
+	for {
+
+		if out.Len() > max {
+			return nil, ErrBlockEnvelope
+		}
+
+		c, e := r.ReadByte()
+		if e == io.EOF {
+			return nil, ErrBlockEnvelope
+		}
+
+		if e != nil {
+			return nil, e
+		}
+
+		switch c {
+		case '{', '[':
+			stack = append(stack, frame{object: c == '{', expectKey: c == '{'})
+			out.WriteByte(c)
+		case '}', ']':
+			if len(stack) == 0 {
+				return nil, ErrBlockEnvelope
+			}
+			stack = stack[:len(stack) - 1]
+			out.WriteByte(c)
+			if len(stack) == 0 {
+				return out.Bytes(), nil
+			}
+		case ':':
+			if len(stack) > 0 {
+				stack[len(stack) - 1].expectKey = false
+			}
+			out.WriteByte(c)
+		case ',':
+			if len(stack) > 0 && stack[len(stack) - 1].object {
+				stack[len(stack) - 1].expectKey = true
+			}
+			out.WriteByte(c)
+		case '"':
+			top := len(stack) - 1
+			if top < 0 {
+				return nil, ErrBlockEnvelope
+			}
+
+			if stack[top].object && stack[top].expectKey {
+				raw, e := readJSONString(r, max)
+				if e != nil {
+					return nil, e
+				}
+				if e := json.Unmarshal(raw, &stack[top].key); e != nil {
+					return nil, ErrBlockEnvelope
+				}
+				out.Write(raw)
+				continue
+			}
+
+			if len(stack) == 2 && stack[0].key == "Block" && stack[1].object && stack[1].key == "Contents" {
+				if found {
+					return nil, ErrBlockEnvelope
+				}
+				found = true
+
+				if e := decodeJSONString(r, w); e != nil {
+					return nil, e
+				}
+				out.WriteString(`""`)
+				continue
+			}
+
+			raw, e := readJSONString(r, max)
+			if e != nil {
+				return nil, e
+			}
+			out.Write(raw)
+		default:
+			out.WriteByte(c)
+		}
+	}
+}
+
+// the rest of a string whose opening quote was read, quoted as it was
+func readJSONString(r *bufio.Reader, max int) ([]byte, error) {
+
+	raw := []byte{'"'}
+	for len(raw) <= max {
+
+		c, e := r.ReadByte()
+		if e != nil {
+			return nil, ErrBlockEnvelope
+		}
+		raw = append(raw, c)
+
+		switch c {
+		case '\\':
+			c, e := r.ReadByte()
+			if e != nil {
+				return nil, ErrBlockEnvelope
+			}
+			raw = append(raw, c)
+		case '"':
+			return raw, nil
+		}
+	}
+
+	return nil, ErrBlockEnvelope
+}
+
+// unescape the rest of a string whose opening quote was read into w
+func decodeJSONString(r *bufio.Reader, w io.Writer) error {
+
+	bw := bufio.NewWriter(w)
+	for {
+
+		c, e := r.ReadByte()
+		if e != nil {
+			return ErrBlockEnvelope
+		}
+
+		if c == '"' {
+			return bw.Flush()
+		}
+
+		if c != '\\' {
+			if e := bw.WriteByte(c); e != nil {
+				return e
+			}
+			continue
+		}
+
+		if c, e = r.ReadByte(); e != nil {
+			return ErrBlockEnvelope
+		}
+
+		switch c {
+		case '"', '\\', '/':
+			bw.WriteByte(c)
+		case 'b':
+			bw.WriteByte('\b')
+		case 'f':
+			bw.WriteByte('\f')
+		case 'n':
+			bw.WriteByte('\n')
+		case 'r':
+			bw.WriteByte('\r')
+		case 't':
+			bw.WriteByte('\t')
+		case 'u':
+			hex := make([]byte, 4)
+			if _, e := io.ReadFull(r, hex); e != nil {
+				return ErrBlockEnvelope
+			}
+			c, ok := jsonHexRune(hex)
+			if !ok {
+				return ErrBlockEnvelope
+			}
+
+			// characters past the BMP come as a pair of escaped surrogates, one
+			// on its own stands for nothing so it's replaced like encoding/json does
+			if utf16.IsSurrogate(c) {
+				next, _ := r.Peek(6)
+				low, ok := rune(0), len(next) == 6 && next[0] == '\\' && next[1] == 'u'
+				if ok {
+					low, ok = jsonHexRune(next[2:])
+				}
+
+				if pair := utf16.DecodeRune(c, low); ok && pair != unicode.ReplacementChar {
+					r.Discard(6)
+					c = pair
+				} else {
+					c = unicode.ReplacementChar
+				}
+			}
+
+			buf := make([]byte, utf8.UTFMax)
+			bw.Write(buf[:utf8.EncodeRune(buf, c)])
+		default:
+			return ErrBlockEnvelope
+		}
+	}
+}
+
+// the rune four hex digits of a \u escape stand for
+func jsonHexRune(hex []byte) (rune, bool) {
+
+	n, e := strconv.ParseUint(string(hex), 16, 16)
+	if e != nil {
+		return 0, false
+	}
+
+	return rune(n), true
+}
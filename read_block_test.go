@@ -0,0 +1,91 @@
+package thorne
+
+import (
+
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+)
+
+// strings are unescaped the way encoding/json would have
+func TestDecodeJSONString(t *testing.T) {
+
+	for _, quoted := range []string{
+		`"plain"`,
+		`"\"\\\/\b\f\n\r\t"`,
+		`"café 世 😀"`,
+		`"\ud83d\ude00 and \uD83D\uDE00"`,
+		`"lone \ud83d and \ude00"`,
+		`"\ud83dA"`,
+		`"\ud83d\ud83d\ude00"`,
+		`"end \ud83d"`,
+	} {
+		var expected string
+		if e := json.Unmarshal([]byte(quoted), &expected); e != nil {
+			t.Fatal(e)
+		}
+
+		var out bytes.Buffer
+		if e := decodeJSONString(bufio.NewReader(strings.NewReader(quoted[1:])), &out); e != nil {
+			t.Fatalf("Failed to decode %s: %s", quoted, e)
+		}
+
+		if out.String() != expected {
+			t.Fatalf("Decoded %s as %q, expected %q", quoted, out.String(), expected)
+		}
+	}
+}
+
+func TestDecodeJSONStringTruncated(t *testing.T) {
+
+	for _, quoted := range []string{
+		`"no end`,
+		`"cut \`,
+		`"cut \u00`,
+		`"bad \u00zz"`,
+		`"bad \q"`,
+	} {
+		var out bytes.Buffer
+		if e := decodeJSONString(bufio.NewReader(strings.NewReader(quoted[1:])), &out); e != ErrBlockEnvelope {
+			t.Fatalf("Expected %s to fail, have %v", quoted, e)
+		}
+	}
+}
+
+// the contents go to the writer and the rest comes back with them emptied
+func TestScanBlockJSON(t *testing.T) {
+
+	block := `{"Block":{"UUID":"a\"b","Contents":"\ud83d\ude00QUJD","Date":"d"},"Signature":"Contents"}`
+
+	var contents bytes.Buffer
+	envelope, e := scanBlockJSON(bufio.NewReader(strings.NewReader(block)), &contents, 1024)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if contents.String() != "😀QUJD" {
+		t.Fatalf("Expected the contents, have %q", contents.String())
+	}
+
+	br := BlockRequest{}
+	if e := json.Unmarshal(envelope, &br); e != nil {
+		t.Fatal(e)
+	}
+
+	if br.Block.Contents != "" || br.Block.UUID != `a"b` || br.Block.Date != "d" || br.Signature != "Contents" {
+		t.Fatalf("Envelope came back wrong: %s", envelope)
+	}
+
+	for _, truncated := range []string{block[:len(block) - 1], block[:40], `{"Block":{"Contents":"QUJD`} {
+		if _, e := scanBlockJSON(bufio.NewReader(strings.NewReader(truncated)), &contents, 1024); e != ErrBlockEnvelope {
+			t.Fatalf("Expected %s to fail, have %v", truncated, e)
+		}
+	}
+
+	if _, e := scanBlockJSON(bufio.NewReader(strings.NewReader(block)), &contents, 16); e != ErrBlockEnvelope {
+		t.Fatalf("Expected the envelope to be too big, have %v", e)
+	}
+}
@@ -0,0 +1,78 @@
+package thorne
+
+import (
+
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+)
+
+// ******************************************************
+// Replay Protection
+// Blocks and requests carry the date they were signed, anything dated
+// too far ahead is refused and blocks that change our keys only run once
+// ******************************************************
+
+// how far a signed date may be ahead of our clock, and for requests behind it
+var MaxClockSkew = 5 * time.Minute
+
+// how long processed blocks are remembered, blocks that change state are ignored once they're older
+var ReplayWindow = 30 * 24 * time.Hour
+
+var ErrStaleRequest 			= errors.New("Request Date is outside the allowed Clock Skew")
+var ErrFutureBlock 				= errors.New("Block is dated in the Future")
+
+// a request is only good for MaxClockSkew either side of now
+func checkRequestDate(date string) error {
+
+	t, e := time.Parse(time.RFC3339, date)
+	if e != nil {
+		return e
+	}
+
+	if d := time.Since(t); d > MaxClockSkew || d < -MaxClockSkew {
+		return ErrStaleRequest
+	}
+
+	return nil
+}
+
+// what a block is remembered by, a digest of what its author signed
+func blockID(br *BlockRequest) (string, error) {
+
+	payload, e := blockSigningPayload(br.SignatureVersion, br)
+	if e != nil {
+		return "", e
+	}
+
+	digest := sha256.Sum256(payload)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// blocks can be read long after they were written but never before
+func checkBlockDate(date string) (time.Time, error) {
+
+	t, e := time.Parse(time.RFC3339, date)
+	if e != nil {
+		return t, e
+	}
+
+	if time.Until(t) > MaxClockSkew {
+		return t, ErrFutureBlock
+	}
+
+	return t, nil
+}
+
+// block types whose handlers change our keys or ledgers rather than just showing something
+func hasSideEffects(blockType string) bool {
+
+	switch blockType {
+	case KeyExchangeInitType, KeyExchangeResponseType, KeyExchangeAckType, KeyRotationType, RatchetInitType, NotificateNewLedgerType:
+		return true
+	}
+
+	return false
+}
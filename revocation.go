@@ -0,0 +1,398 @@
+package thorne
+
+import (
+
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+)
+
+// ******************************************************
+// Revocation
+// Certificates that declare an identity, rsa or device key dead, made ahead of
+// time and kept offline so a lost device can be cut off without it.
+// A certificate takes effect when it is published unless it names an
+// earlier time itself. Whoever holds a revoked key can still date what they
+// sign before the revocation so signatures are also judged by when we first
+// saw them
+// ******************************************************
+const (
+
+	REVOKE_IDENTITY_KEY 		= "identity"
+	REVOKE_RSA_KEY 					= "rsa"
+	REVOKE_DEVICE_KEY 			= "device"
+
+)
+
+const REVOCATION_ARMOR_TYPE = "THORNE REVOCATION"
+
+type RevocationCertificate struct {
+
+	UUID 										string 				// the account
+	KeyType 								string 				// one of the REVOKE_* key types
+	Key 										string 				// base64 of the public key being revoked
+	SignerKey 							string 				// base64 of the identity key that signed this, the same as Key for identity keys
+	Reason 									string
+	Created 								string 				// when the certificate was made (RFC3339)
+	Effective 							string 				// optional, when the key stopped being trusted if that's before publication
+	Signature 							string
+
+}
+
+// a certificate as the API published it
+type PublishedRevocation struct {
+
+	Certificate 						RevocationCertificate
+	Published 							string 				// set by the API when the certificate was published
+
+}
+
+// published next to public.key
+type RevocationList struct {
+
+	UUID 										string
+	Revocations 						[]PublishedRevocation
+
+}
+
+type RevocationResponse struct {
+
+	Success 								bool
+	Error 									string
+
+}
+
+var ErrKeyRevoked 				= errors.New("Key has been Revoked")
+var ErrRevocation 				= errors.New("Invalid Revocation Certificate")
+
+func revocationPayload(rc *RevocationCertificate) []byte {
+	return encodeFields([]byte("thorne/revocation"), []byte(rc.UUID), []byte(rc.KeyType), []byte(rc.Key), []byte(rc.SignerKey), []byte(rc.Reason), []byte(rc.Created), []byte(rc.Effective))
+}
+
+// make a certificate revoking our identity or rsa key, store it somewhere safe and publish it when needed
+func GenerateRevocationCertificate(ks *KeyStore, keyType string, reason string) (*RevocationCertificate, error) {
+
+	switch keyType {
+	case REVOKE_IDENTITY_KEY:
+		if ks.IdentitySigner() == nil {
+			return nil, ErrNoIdentityKey
+		}
+
+		identity, ok := ks.IdentitySigner().Public().(*ecdsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("Identity Key isn't an ECDSA Key")
+		}
+		return newRevocationCertificate(ks, keyType, encodePublicKey(identity), reason)
+	case REVOKE_RSA_KEY:
+		decrypter := ks.RSADecrypter()
+		if decrypter == nil {
+			return nil, ErrNoRSAKey
+		}
+
+		rsaKey, ok := decrypter.Public().(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("RSA Key isn't an RSA Key")
+		}
+		return newRevocationCertificate(ks, keyType, base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(rsaKey)), reason)
+	}
+
+	return nil, fmt.Errorf("Unknown Key Type: %s", keyType)
+}
+
+// a certificate revoking key signed by the account's identity key
+func newRevocationCertificate(ks *KeyStore, keyType string, key string, reason string) (*RevocationCertificate, error) {
+
+	signer := ks.IdentitySigner()
+	if signer == nil {
+		return nil, ErrNoIdentityKey
+	}
+
+	identity, ok := signer.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Identity Key isn't an ECDSA Key")
+	}
+
+	rc := &RevocationCertificate{UUID: ks.UUID, KeyType: keyType, Key: key, SignerKey: encodePublicKey(identity), Reason: reason, Created: time.Now().UTC().Format(time.RFC3339)}
+	signature, e := GenerateSignature(signer, revocationPayload(rc))
+	if e != nil {
+		return nil, e
+	}
+	rc.Signature = base64.StdEncoding.EncodeToString(signature)
+
+	return rc, nil
+}
+
+// armor a certificate so it can be printed or stored as text
+func (rc *RevocationCertificate) Armor() (string, error) {
+
+	buf, e := json.Marshal(rc)
+	if e != nil {
+		log.Printf("Failed to Marshal RevocationCertificate: %s", e)
+		return "", e
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: REVOCATION_ARMOR_TYPE, Bytes: buf})), nil
+}
+
+// read a certificate, armored or not
+func ParseRevocationCertificate(buf []byte) (*RevocationCertificate, error) {
+
+	if trimmed := bytes.TrimSpace(buf); bytes.HasPrefix(trimmed, []byte("-----BEGIN")) {
+		block, _ := pem.Decode(trimmed)
+		if block == nil || block.Type != REVOCATION_ARMOR_TYPE {
+			return nil, ErrRevocation
+		}
+		buf = block.Bytes
+	}
+
+	rc := &RevocationCertificate{}
+	if e := json.Unmarshal(buf, rc); e != nil {
+		log.Printf("Failed to Unmarshal RevocationCertificate: %s", e)
+		return nil, ErrRevocation
+	}
+
+	return rc, nil
+}
+
+// publish a certificate, this needs no keystore so it works from offline storage
+func PublishRevocation(rc *RevocationCertificate) error {
+
+	if e := rc.verify(); e != nil {
+		return e
+	}
+
+	buf, e := json.Marshal(rc)
+	if e != nil {
+		log.Printf("Failed to Marshal RevocationCertificate: %s", e)
+		return e
+	}
+
+	c := &http.Client{}
+	r, e := http.NewRequest("PUT", "https://thorne.app/api/revoke", bytes.NewBuffer(buf))
+	if e != nil {
+		log.Printf("Failed to create request: %s", e)
+		return e
+	}
+
+	x, e := c.Do(r)
+	if e != nil {
+		log.Printf("Revoke API Failed: %s", e)
+		return e
+	}
+	defer x.Body.Close()
+
+	if x.StatusCode != 200 {
+		return fmt.Errorf("Failed to publish revocation: %d", x.StatusCode)
+	}
+
+	if buf, e = ioutil.ReadAll(x.Body); e != nil {
+		log.Printf("Failed to read response body: %s", e)
+		return e
+	}
+
+	resp := RevocationResponse{}
+	if e := json.Unmarshal(buf, &resp); e != nil {
+		log.Printf("Failed to unmarshal revoke response: %s", e)
+		return e
+	}
+
+	if !resp.Success {
+		return fmt.Errorf("Failed to publish revocation: %s", resp.Error)
+	}
+
+	return nil
+}
+
+// the certificate has to be signed by the identity key it names
+func (rc *RevocationCertificate) verify() error {
+
+	if rc.KeyType != REVOKE_IDENTITY_KEY && rc.KeyType != REVOKE_RSA_KEY && rc.KeyType != REVOKE_DEVICE_KEY {
+		return ErrRevocation
+	}
+
+	if rc.KeyType == REVOKE_IDENTITY_KEY && rc.Key != rc.SignerKey {
+		return ErrRevocation
+	}
+
+	signer := decodePublicKey(rc.SignerKey)
+	if signer == nil || !VerifySignature(signer, rc.Signature, revocationPayload(rc)) {
+		return ErrRevocation
+	}
+
+	return nil
+}
+
+// fetch the revocations published for an account
+func GetRevocations(uuid string) (*RevocationList, error) {
+
+	x, e := http.Get(userKeyURL(uuid, "revocations.json"))
+	if e != nil {
+		log.Printf("Failed to get revocations: %s", e)
+		return nil, e
+	}
+	defer x.Body.Close()
+
+	if x.StatusCode == 404 || x.StatusCode == 403 {
+		return &RevocationList{UUID: uuid}, nil
+	}
+
+	if x.StatusCode != 200 {
+		return nil, fmt.Errorf("Failed to get revocations: %d", x.StatusCode)
+	}
+
+	buf, e := ioutil.ReadAll(x.Body)
+	if e != nil {
+		return nil, e
+	}
+
+	rl := &RevocationList{}
+	if e := json.Unmarshal(buf, rl); e != nil {
+		log.Printf("Failed to unmarshal revocations: %s", e)
+		return nil, e
+	}
+
+	return rl, nil
+}
+
+// when key stopped being trusted, false if it never was revoked. only certificates signed
+// by the key signerAt gives for the time they were published count
+func (rl *RevocationList) RevokedAt(keyType string, key string, signerAt func(published time.Time) string) (time.Time, bool) {
+
+	var at time.Time
+	revoked := false
+	for _, v := range rl.Revocations {
+
+		rc := v.Certificate
+		if rc.UUID != rl.UUID || rc.KeyType != keyType || rc.Key != key || rc.verify() != nil {
+			continue
+		}
+
+		t, e := time.Parse(time.RFC3339, v.Published)
+		if e != nil || rc.SignerKey != signerAt(t) {
+			continue
+		}
+
+		if effective, e := time.Parse(time.RFC3339, rc.Effective); e == nil && effective.Before(t) {
+			t = effective
+		}
+
+		if !revoked || t.Before(at) {
+			at = t
+			revoked = true
+		}
+	}
+
+	return at, revoked
+}
+
+// refuse an identity key for anything signed or first seen at or after its revocation
+func checkIdentityRevocation(uuid string, key *ecdsa.PublicKey, date string, seen time.Time) error {
+
+	signed, e := time.Parse(time.RFC3339, date)
+	if e != nil {
+		return e
+	}
+
+	rl, e := GetRevocations(uuid)
+	if e != nil {
+		return e
+	}
+
+	// a key can only be revoked by itself
+	encoded := encodePublicKey(key)
+	if at, ok := rl.RevokedAt(REVOKE_IDENTITY_KEY, encoded, func(time.Time) string { return encoded }); ok && (!signed.Before(at) || !seen.Before(at)) {
+		log.Printf("Identity Key for %s was revoked at %s", uuid, at.Format(time.RFC3339))
+		return ErrKeyRevoked
+	}
+
+	return nil
+}
+
+// refuse an rsa key that has been revoked at all, it is only ever used going forward
+func checkRSARevocation(uuid string, key *rsa.PublicKey) error {
+
+	rl, e := GetRevocations(uuid)
+	if e != nil {
+		return e
+	}
+
+	if len(rl.Revocations) == 0 {
+		return nil
+	}
+
+	signerAt, e := accountSignerAt(uuid)
+	if e != nil {
+		return e
+	}
+
+	if at, ok := rl.RevokedAt(REVOKE_RSA_KEY, base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(key)), signerAt); ok {
+		log.Printf("RSA Key for %s was revoked at %s", uuid, at.Format(time.RFC3339))
+		return ErrKeyRevoked
+	}
+
+	return nil
+}
+
+// refuse a device key for anything signed or first seen at or after its revocation
+func checkDeviceRevocation(uuid string, key string, date string, seen time.Time) error {
+
+	signed, e := time.Parse(time.RFC3339, date)
+	if e != nil {
+		return e
+	}
+
+	rl, e := GetRevocations(uuid)
+	if e != nil {
+		return e
+	}
+
+	if len(rl.Revocations) == 0 {
+		return nil
+	}
+
+	signerAt, e := accountSignerAt(uuid)
+	if e != nil {
+		return e
+	}
+
+	if at, ok := rl.RevokedAt(REVOKE_DEVICE_KEY, key, signerAt); ok && (!signed.Before(at) || !seen.Before(at)) {
+		log.Printf("Device Key for %s was revoked at %s", uuid, at.Format(time.RFC3339))
+		return ErrKeyRevoked
+	}
+
+	return nil
+}
+
+// the identity key the account held at a given time, only that key may revoke its other keys
+// so one that has been rotated away can't
+func accountSignerAt(uuid string) (func(time.Time) string, error) {
+
+	current := GetPublicKey(uuid)
+	if current == nil || current.X == nil {
+		return nil, fmt.Errorf("No Public Key for %s", uuid)
+	}
+
+	history, e := GetKeyHistory(uuid)
+	if e != nil {
+		return nil, e
+	}
+
+	return func(at time.Time) string {
+		key, e := history.KeyAt(current, at.UTC().Format(time.RFC3339), at)
+		if e != nil {
+			return ""
+		}
+		return encodePublicKey(key)
+	}, nil
+}
@@ -2,8 +2,10 @@ package thorne
 
 import (
 
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
 	"errors"
@@ -45,14 +47,23 @@ func rsaParsePublicKey(publicKeyString string) (*rsa.PublicKey, error) {
 	return publicKey, nil
 }
 
-func rsaDecrypt(key *rsa.PrivateKey, cipherString string) (string, error) {
+func encodeRSAPublicKey(key *rsa.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(key))
+}
+
+func rsaDecrypt(key crypto.Decrypter, cipherString string) (string, error) {
+
+	if key == nil {
+		return "", ErrNoRSAKey
+	}
 
 	cipher, e := base64.StdEncoding.DecodeString(cipherString)
 	if e != nil {
 		return "", e
 	}
 
-	b, e := rsa.DecryptPKCS1v15(nil, key, cipher)
+	// nil options select PKCS#1 v1.5 for rsa keys
+	b, e := key.Decrypt(rand.Reader, cipher, nil)
 	if e != nil {
 		return "", e
 	}
@@ -68,4 +79,33 @@ func rsaEncypt(key *rsa.PublicKey, plaintext string) (string, error) {
 	}
 
 	return base64.StdEncoding.EncodeToString(b), nil
-}
\ No newline at end of file
+}
+
+func rsaDecryptOAEP(key crypto.Decrypter, cipherString string) (string, error) {
+
+	if key == nil {
+		return "", ErrNoRSAKey
+	}
+
+	cipher, e := base64.StdEncoding.DecodeString(cipherString)
+	if e != nil {
+		return "", e
+	}
+
+	b, e := key.Decrypt(rand.Reader, cipher, &rsa.OAEPOptions{Hash: crypto.SHA256})
+	if e != nil {
+		return "", e
+	}
+
+	return string(b), nil
+}
+
+func rsaEncryptOAEP(key *rsa.PublicKey, plaintext string) (string, error) {
+
+	b, e := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, []byte(plaintext), nil)
+	if e != nil {
+		return "", e
+	}
+
+	return base64.StdEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,312 @@
+package thorne
+
+import (
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+)
+
+// ******************************************************
+// Safety Numbers
+// A number both sides of a connection can read to each other out of
+// band, made from each side's uuid, identity and rsa keys. If the
+// numbers match nobody swapped keys during the key exchange
+// ******************************************************
+const (
+
+	SAFETY_NUMBER_ITERATIONS 		= 5200 		// rounds of sha512 per fingerprint, slows down searching for a lookalike
+	SAFETY_NUMBER_FINGERPRINT 	= 30 			// bytes of each side's fingerprint used, six groups of five digits
+	SAFETY_NUMBER_WORDS 				= 8
+
+)
+
+type SafetyNumber struct {
+
+	Digits 									string 				// twelve groups of five digits
+	Words 									[]string 			// the same keys as words, easier to read over the phone
+
+}
+
+var ErrNoConnection 				= errors.New("No Connection with User")
+var ErrSafetyNumberMismatch = errors.New("Safety Number doesn't match the User's Keys")
+var ErrSafetyNumberChanged 	= errors.New("Verified Connection's Keys have Changed")
+
+func (sn *SafetyNumber) String() string {
+	return sn.Digits + "\n" + strings.Join(sn.Words, " ")
+}
+
+func (sn *SafetyNumber) Equal(o *SafetyNumber) bool {
+	return o != nil && sn.Digits == o.Digits && strings.Join(sn.Words, " ") == strings.Join(o.Words, " ")
+}
+
+// the safety number for our connection with uuid, from the keys pinned when it was made
+func ConnectionSafetyNumber(ks *KeyStore, uuid string) (*SafetyNumber, error) {
+
+	c, ok := ks.Connection(uuid)
+	if !ok {
+		return nil, ErrNoConnection
+	}
+
+	// connections from before keys were pinned take the ones published now
+	if c.Fingerprint == "" {
+		if e := CheckConnectionKeys(ks, uuid); e != nil {
+			return nil, e
+		}
+		c, _ = ks.Connection(uuid)
+	}
+
+	ours, e := ownFingerprint(ks)
+	if e != nil {
+		return nil, e
+	}
+
+	theirs, e := hex.DecodeString(c.Fingerprint)
+	if e != nil {
+		return nil, e
+	}
+
+	return safetyNumber(ks.UUID, ours, uuid, theirs), nil
+}
+
+// mark a connection verified once the user has compared sn with the other side, refused
+// if their keys changed since they were pinned
+func VerifyConnection(ks *KeyStore, uuid string, sn *SafetyNumber) error {
+
+	c, ok := ks.Connection(uuid)
+	if !ok {
+		return ErrNoConnection
+	}
+
+	if c.KeysChanged {
+		return ErrSafetyNumberChanged
+	}
+
+	current, e := ConnectionSafetyNumber(ks, uuid)
+	if e != nil {
+		return e
+	}
+
+	if !current.Equal(sn) {
+		return ErrSafetyNumberMismatch
+	}
+
+	c, _ = ks.Connection(uuid)
+	c.Verified = true
+	ks.AddConnection(c)
+
+	return nil
+}
+
+// compare the keys uuid has published with the ones pinned for the connection. once they
+// differ the connection loses any verification and this keeps failing until the new keys
+// are taken with AcceptConnectionKeys
+func CheckConnectionKeys(ks *KeyStore, uuid string) error {
+
+	c, ok := ks.Connection(uuid)
+	if !ok {
+		return ErrNoConnection
+	}
+
+	identity, rsaKey, e := userKeys(uuid)
+	if e != nil {
+		return e
+	}
+
+	return pinConnectionKeys(ks, c, identity, rsaKey)
+}
+
+// pin the keys uuid has published now after they changed, the connection has to be verified again
+func AcceptConnectionKeys(ks *KeyStore, uuid string) error {
+
+	c, ok := ks.Connection(uuid)
+	if !ok {
+		return ErrNoConnection
+	}
+
+	identity, rsaKey, e := userKeys(uuid)
+	if e != nil {
+		return e
+	}
+
+	c.Fingerprint, c.Verified, c.KeysChanged = "", false, false
+	return pinConnectionKeys(ks, c, identity, rsaKey)
+}
+
+func pinConnectionKeys(ks *KeyStore, c Connection, identity *ecdsa.PublicKey, rsaKey *rsa.PublicKey) error {
+
+	current := hex.EncodeToString(keyFingerprint(c.UUID, identity, rsaKey))
+	if c.Fingerprint == current && !c.KeysChanged {
+		return nil
+	}
+
+	if c.Fingerprint != "" {
+		log.Printf("WARNING: Keys for connection %s have changed, compare safety numbers again", c.UUID)
+		c.Verified = false
+		c.KeysChanged = true
+		ks.AddConnection(c)
+		return ErrSafetyNumberChanged
+	}
+
+	c.Fingerprint = current
+	ks.AddConnection(c)
+	return nil
+}
+
+// keep the connection a key exchange is making, pinning the identity key that vouched for
+// the peer and the rsa key we encrypted to. exchanges from before signing had no identity
+// key vouch for them so the published one stands in
+func recordConnection(ks *KeyStore, uuid string, identity *ecdsa.PublicKey, rsaKey string) error {
+
+	if identity == nil {
+		if identity = GetPublicKey(uuid); identity == nil || identity.X == nil {
+			return fmt.Errorf("No Public Key for %s", uuid)
+		}
+	}
+
+	var peerRSA *rsa.PublicKey
+	var e error
+	if rsaKey != "" {
+		peerRSA, e = rsaParsePublicKey(rsaKey)
+	} else {
+		peerRSA, e = RsaGetPublicKey(uuid)
+	}
+
+	if e != nil {
+		return e
+	}
+
+	c, ok := ks.Connection(uuid)
+	if !ok {
+		c = Connection{UUID: uuid, Direct: true}
+	}
+
+	return pinConnectionKeys(ks, c, identity, peerRSA)
+}
+
+func ownFingerprint(ks *KeyStore) ([]byte, error) {
+
+	// a device without the identity or rsa key goes by the published ones
+	var identity *ecdsa.PublicKey
+	if signer := ks.IdentitySigner(); signer != nil {
+		var ok bool
+		if identity, ok = signer.Public().(*ecdsa.PublicKey); !ok {
+			return nil, fmt.Errorf("Identity Key isn't an ECDSA Key")
+		}
+	} else if identity = GetPublicKey(ks.UUID); identity == nil {
+		return nil, ErrNoIdentityKey
+	}
+
+	var rsaKey *rsa.PublicKey
+	if decrypter := ks.RSADecrypter(); decrypter != nil {
+		var ok bool
+		if rsaKey, ok = decrypter.Public().(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("RSA Key isn't an RSA Key")
+		}
+	} else {
+		var e error
+		if rsaKey, e = RsaGetPublicKey(ks.UUID); e != nil {
+			return nil, e
+		}
+	}
+
+	return keyFingerprint(ks.UUID, identity, rsaKey), nil
+}
+
+func userKeys(uuid string) (*ecdsa.PublicKey, *rsa.PublicKey, error) {
+
+	identity := GetPublicKey(uuid)
+	if identity == nil || identity.X == nil {
+		return nil, nil, fmt.Errorf("No Public Key for %s", uuid)
+	}
+
+	rsaKey, e := RsaGetPublicKey(uuid)
+	if e != nil {
+		return nil, nil, e
+	}
+
+	return identity, rsaKey, nil
+}
+
+func keyFingerprint(uuid string, identity *ecdsa.PublicKey, rsaKey *rsa.PublicKey) []byte {
+
+	keys := encodeFields([]byte("thorne/fingerprint"), []byte(uuid), elliptic.Marshal(elliptic.P521(), identity.X, identity.Y), x509.MarshalPKCS1PublicKey(rsaKey))
+
+	digest := sha512.Sum512(keys)
+	for i := 1; i < SAFETY_NUMBER_ITERATIONS; i++ {
+		digest = sha512.Sum512(append(digest[:], keys...))
+	}
+
+	return digest[:SAFETY_NUMBER_FINGERPRINT]
+}
+
+// both sides have to come up with the same number so the fingerprints go in ordered by uuid
+func safetyNumber(uuidA string, a []byte, uuidB string, b []byte) *SafetyNumber {
+
+	if uuidB < uuidA {
+		a, b = b, a
+	}
+
+	groups := []string{}
+	for _, fingerprint := range [][]byte{a, b} {
+		for i := 0; i + 5 <= len(fingerprint); i += 5 {
+			n := binary.BigEndian.Uint64(append([]byte{0, 0, 0}, fingerprint[i:i + 5]...))
+			groups = append(groups, fmt.Sprintf("%05d", n % 100000))
+		}
+	}
+
+	digest := sha256.Sum256(encodeFields([]byte("thorne/safety-words"), a, b))
+	words := []string{}
+	for _, v := range digest[:SAFETY_NUMBER_WORDS] {
+		words = append(words, safetyWords[v])
+	}
+
+	return &SafetyNumber{Digits: strings.Join(groups, " "), Words: words}
+}
+
+var safetyWords = [256]string{
+
+	"acid", "acorn", "actor", "adult", "agent", "alarm", "album", "alley",
+	"amber", "anchor", "angle", "ankle", "apple", "apron", "arena", "armor",
+	"arrow", "atlas", "attic", "aunt", "autumn", "award", "bacon", "badge",
+	"bagel", "baker", "bamboo", "banjo", "barrel", "basil", "basket", "beach",
+	"beacon", "beard", "beaver", "bell", "bench", "berry", "bishop", "blade",
+	"blanket", "board", "bonnet", "border", "bottle", "bracket", "branch", "bread",
+	"breeze", "brick", "bridge", "bronze", "brush", "bubble", "bucket", "bundle",
+	"butter", "button", "cabin", "cable", "cactus", "camel", "camera", "candle",
+	"canoe", "canyon", "carpet", "carrot", "castle", "cattle", "cedar", "cellar",
+	"chalk", "channel", "cherry", "chess", "circle", "citrus", "clock", "cloud",
+	"clover", "cobalt", "comet", "copper", "coral", "cotton", "cradle", "crater",
+	"crayon", "crown", "curtain", "dagger", "daisy", "dancer", "delta", "desert",
+	"diamond", "dinner", "dolphin", "donkey", "dragon", "drawer", "dream", "eagle",
+	"easel", "echo", "elbow", "ember", "engine", "falcon", "feather", "fence",
+	"ferry", "fiddle", "finger", "flag", "flame", "flute", "forest", "fossil",
+	"fox", "galaxy", "garden", "garlic", "gate", "giant", "ginger", "glacier",
+	"glove", "goose", "granite", "grape", "gravel", "guitar", "hammer", "harbor",
+	"harvest", "hazel", "helmet", "hermit", "hinge", "honey", "hornet", "iceberg",
+	"igloo", "island", "ivory", "jacket", "jaguar", "jelly", "jewel", "jungle",
+	"kayak", "kernel", "kettle", "kitten", "ladder", "lagoon", "laser", "lemon",
+	"lily", "linen", "lizard", "lobster", "locket", "lumber", "magnet", "mango",
+	"maple", "marble", "meadow", "melon", "mirror", "mitten", "monkey", "mosaic",
+	"motor", "muffin", "napkin", "needle", "nest", "nickel", "noodle", "oasis",
+	"ocean", "olive", "onion", "orange", "orchid", "otter", "oven", "oyster",
+	"paddle", "palace", "panda", "parrot", "peach", "pebble", "pepper", "piano",
+	"pillow", "pilot", "pine", "planet", "plum", "pocket", "pony", "puzzle",
+	"quartz", "quiver", "rabbit", "radar", "raft", "rainbow", "raven", "ribbon",
+	"river", "robin", "rocket", "saddle", "salmon", "satin", "scarf", "shell",
+	"shovel", "silver", "sketch", "sparrow", "spider", "spoon", "stone", "sugar",
+	"summit", "sunset", "swan", "table", "temple", "thunder", "tiger", "timber",
+	"tomato", "tulip", "tunnel", "turtle", "valley", "velvet", "violin", "wagon",
+	"walnut", "whale", "willow", "window", "winter", "wizard", "yacht", "zebra",
+
+}
@@ -0,0 +1,82 @@
+package thorne
+
+import (
+
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+
+)
+
+// ******************************************************
+// Sealed Payloads
+// Anything too large for rsa is encrypted with a one time aes key
+// and only that key is wrapped for the recipient
+// ******************************************************
+type SealedPayload struct {
+
+	WrappedKey 							string 					// aes key wrapped with the recipient's rsa key (OAEP)
+	Ciphertext 							string 					// nonce + aes-gcm ciphertext
+
+}
+
+// seal for the holder of the rsa key
+func SealPayload(key *rsa.PublicKey, plaintext []byte) (*SealedPayload, error) {
+
+	pass := GeneratePass()
+	if pass == nil {
+		return nil, fmt.Errorf("Failed to generate payload key")
+	}
+	defer wipe(pass)
+
+	wrapped, e := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, pass, nil)
+	if e != nil {
+		log.Printf("Failed to wrap payload key: %s", e)
+		return nil, e
+	}
+
+	sp := &SealedPayload{WrappedKey: base64.StdEncoding.EncodeToString(wrapped)}
+	if sp.Ciphertext, e = sealWithPass(pass, plaintext); e != nil {
+		return nil, e
+	}
+
+	return sp, nil
+}
+
+// open a payload sealed for our rsa key, unwrapped thru RSADecrypter so it works
+// wherever the key is held
+func OpenPayload(ks *KeyStore, sp *SealedPayload) ([]byte, error) {
+
+	s, e := rsaDecryptOAEP(ks.RSADecrypter(), sp.WrappedKey)
+	if e != nil {
+		log.Printf("Failed to unwrap payload key: %s", e)
+		return nil, e
+	}
+	pass := []byte(s)
+	defer wipe(pass)
+
+	cipher, e := base64.StdEncoding.DecodeString(sp.Ciphertext)
+	if e != nil {
+		return nil, e
+	}
+
+	if len(cipher) < 12 {
+		return nil, fmt.Errorf("Sealed Payload is too short")
+	}
+
+	return Decrypt(pass, cipher)
+}
+
+func sealWithPass(pass []byte, plaintext []byte) (string, error) {
+
+	cipher, nonce, e := Crypt(pass, plaintext)
+	if e != nil {
+		log.Printf("Failed to Encrypt Payload: %s", e)
+		return "", e
+	}
+
+	return base64.StdEncoding.EncodeToString(append(nonce, cipher...)), nil
+}
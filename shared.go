@@ -110,18 +110,32 @@ func RsaGetPublicKey(uuid string) (*rsa.PublicKey, error) {
 
 func VerifySignature(publicKey *ecdsa.PublicKey, signature string, data []byte) bool {
 
+  hash := sha256.Sum256(data)
+  return VerifyDigestSignature(publicKey, signature, hash[:])
+}
+
+// like VerifySignature for a SHA256 digest that was hashed as the data streamed past
+func VerifyDigestSignature(publicKey *ecdsa.PublicKey, signature string, digest []byte) bool {
+
+  if publicKey == nil || publicKey.X == nil {
+    log.Printf("No Public Key to verify with")
+    return false
+  }
+
+  // signatures come from peers so a malformed one is a failed verification, not a crash
   der, e := base64.StdEncoding.DecodeString(signature)
   if e != nil {
-      log.Fatalf("Error: %s", e)
+    log.Printf("Error: %s", e)
+    return false
   }
 
   // unmarshal the R and S components of the ASN.1-encoded signature into our
   // signature data structure
   sig := &ECDSASignature{}
   if _, e = asn1.Unmarshal(der, sig); e != nil {
-    log.Fatalf("ASN1 Unmarshal Error: %s", e)
+    log.Printf("ASN1 Unmarshal Error: %s", e)
+    return false
   }
 
-  hash := sha256.Sum256(data)
-  return ecdsa.Verify(publicKey, hash[:], sig.R, sig.S)
+  return ecdsa.Verify(publicKey, digest, sig.R, sig.S)
 }
\ No newline at end of file
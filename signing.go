@@ -0,0 +1,224 @@
+package thorne
+
+import (
+
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+)
+
+// ******************************************************
+// Signed Payloads
+// What gets signed for each request type, v2 length prefixes every
+// field behind a per type domain so no two requests sign the same bytes
+// ******************************************************
+const (
+
+	SIGNATURE_V1 						= iota 		// fields concatenated as is, what a missing SignatureVersion means
+	SIGNATURE_V2 											// length prefixed and domain separated
+	SIGNATURE_V3 											// v2 plus the parent block and attachment metadata
+
+)
+
+// the version we sign with
+var SignatureVersion = SIGNATURE_V2
+
+// the oldest version we still accept, raise it once every writer has moved on
+var MinSignatureVersion = SIGNATURE_V1
+
+var ErrSignatureVersion 		= errors.New("Signature Version is not Supported")
+var ErrBlockSignature 			= errors.New("Block Signature doesn't Verify")
+
+func blockSigningPayload(version int, br *BlockRequest) ([]byte, error) {
+
+	b := &br.Block
+	switch version {
+	case SIGNATURE_V1:
+		return []byte(b.UUID + b.Ledger + b.Contents + b.Date + b.BlockType), nil
+	case SIGNATURE_V2, SIGNATURE_V3:
+		// contents go in as a digest so a streamed body can be signed as it passes
+		contents := sha256.Sum256([]byte(b.Contents))
+		return blockSigningFields(version, br, contents[:]), nil
+	}
+
+	return nil, ErrSignatureVersion
+}
+
+// UID and each Attachment's UUID are handed out by the API after signing so they're left out
+func blockSigningFields(version int, br *BlockRequest, contentsDigest []byte) []byte {
+
+	b := &br.Block
+	if version == SIGNATURE_V2 {
+		return encodeFields(withDevice(b.Device, []byte("thorne/sig/v2/block"), []byte(b.UUID), []byte(b.Ledger), contentsDigest, []byte(b.Date), []byte(b.BlockType))...)
+	}
+
+	attachments := [][]byte{}
+	for _, v := range b.Attachments {
+		a := v.Attachment
+		attachments = append(attachments, encodeFields([]byte(a.Name), []byte(a.SHA256), []byte(strconv.Itoa(a.Size)), []byte(a.ContentType), []byte(a.URL)))
+	}
+
+	return encodeFields(withDevice(b.Device, []byte("thorne/sig/v3/block"), []byte(b.UUID), []byte(b.Ledger), contentsDigest, []byte(b.Date), []byte(b.BlockType), []byte(br.ParentBlock), encodeFields(attachments...))...)
+}
+
+// blocks and requests signed by a device name it last, identity signed ones stay as they were
+func withDevice(device string, fields ...[]byte) [][]byte {
+
+	if device != "" {
+		fields = append(fields, []byte(device))
+	}
+
+	return fields
+}
+
+func ledgerSigningPayload(version int, lb *LedgerBlock) ([]byte, error) {
+
+	switch version {
+	case SIGNATURE_V1:
+		return []byte(lb.UUID + fmt.Sprintf("%d", lb.LedgerType) + lb.Date), nil
+	case SIGNATURE_V2:
+		users := [][]byte{}
+		for _, v := range lb.AdditionalUsers {
+			users = append(users, []byte(v))
+		}
+
+		return encodeFields(withDevice(lb.Device, []byte("thorne/sig/v2/ledger"), []byte(lb.UUID), []byte(strconv.Itoa(lb.LedgerType)), []byte(lb.Date), []byte(lb.Name), []byte(lb.Description), []byte(lb.Site), []byte(strconv.FormatBool(lb.HasIcon)), encodeFields(users...))...), nil
+	}
+
+	return nil, ErrSignatureVersion
+}
+
+func ledgerLastBlockSigningPayload(version int, llb *LedgerLastBlock) ([]byte, error) {
+
+	switch version {
+	case SIGNATURE_V1:
+		return []byte(llb.UUID + llb.Date + llb.LedgerUUID), nil
+	case SIGNATURE_V2:
+		return encodeFields(withDevice(llb.Device, []byte("thorne/sig/v2/getledger"), []byte(llb.UUID), []byte(llb.Date), []byte(llb.LedgerUUID))...), nil
+	}
+
+	return nil, ErrSignatureVersion
+}
+
+// check the author's signature on a block at whichever version it was signed with, a
+// block that hasn't been fetched from its ledger is judged as first seen now
+func VerifyBlockSignature(br *BlockRequest) bool {
+	return verifyBlockSignature(br) == nil
+}
+
+func verifyBlockSignature(br *BlockRequest) error {
+
+	if br.SignatureVersion < MinSignatureVersion {
+		log.Printf("Block from %s signed with retired version %d", br.Block.UUID, br.SignatureVersion)
+		return ErrSignatureVersion
+	}
+
+	payload, e := blockSigningPayload(br.SignatureVersion, br)
+	if e != nil {
+		log.Printf("Block from %s: %s", br.Block.UUID, e)
+		return e
+	}
+
+	digest := sha256.Sum256(payload)
+	return verifyBlockDigest(br, digest[:])
+}
+
+// check the author's signature over the digest of a block's signing payload, for
+// blocks whose contents were hashed as they streamed past instead of held
+func verifyBlockDigest(br *BlockRequest, digest []byte) error {
+
+	key, e := blockAuthorKey(br)
+	if e != nil {
+		log.Printf("No Public Key for %s at %s: %s", br.Block.UUID, br.Block.Date, e)
+		return e
+	}
+
+	if !VerifyDigestSignature(key, br.Signature, digest) {
+		return ErrBlockSignature
+	}
+
+	return nil
+}
+
+// blocks are checked against the key the author or their device held when they were written
+func blockAuthorKey(br *BlockRequest) (*ecdsa.PublicKey, error) {
+
+	if br.Block.Device != "" {
+		// a v1 payload doesn't name the device so it could be moved to another
+		if br.SignatureVersion < SIGNATURE_V2 {
+			return nil, ErrSignatureVersion
+		}
+
+		return DeviceKeyAt(br.Block.UUID, br.Block.Device, br.Block.Date, br.seenBy())
+	}
+
+	key, e := PublicKeyAt(br.Block.UUID, br.Block.Date, br.seenBy())
+	if e != nil {
+		return nil, e
+	}
+
+	// the date is the author's word, a revoked key could backdate anything
+	if e := checkIdentityRevocation(br.Block.UUID, key, br.Block.Date, br.seenBy()); e != nil {
+		return nil, e
+	}
+
+	return key, nil
+}
+
+// requests are only good within MaxClockSkew of their date
+func VerifyLedgerSignature(lr *LedgerRequest) bool {
+
+	if lr.SignatureVersion < MinSignatureVersion || checkRequestDate(lr.LedgerBlock.Date) != nil {
+		return false
+	}
+
+	payload, e := ledgerSigningPayload(lr.SignatureVersion, &lr.LedgerBlock)
+	if e != nil {
+		return false
+	}
+
+	key, e := requestAuthorKey(lr.SignatureVersion, lr.LedgerBlock.UUID, lr.LedgerBlock.Device, lr.LedgerBlock.Date)
+	if e != nil {
+		return false
+	}
+
+	return VerifySignature(key, lr.Signature, payload)
+}
+
+func VerifyLedgerBlockSignature(lbr *LedgerBlockRequest) bool {
+
+	if lbr.SignatureVersion < MinSignatureVersion || checkRequestDate(lbr.LedgerLastBlock.Date) != nil {
+		return false
+	}
+
+	payload, e := ledgerLastBlockSigningPayload(lbr.SignatureVersion, &lbr.LedgerLastBlock)
+	if e != nil {
+		return false
+	}
+
+	key, e := requestAuthorKey(lbr.SignatureVersion, lbr.LedgerLastBlock.UUID, lbr.LedgerLastBlock.Device, lbr.LedgerLastBlock.Date)
+	if e != nil {
+		return false
+	}
+
+	return VerifySignature(key, lbr.Signature, payload)
+}
+
+// requests are made now so the key that signed them has to be good now
+func requestAuthorKey(version int, uuid string, device string, date string) (*ecdsa.PublicKey, error) {
+
+	if device == "" {
+		return GetPublicKey(uuid), nil
+	}
+
+	if version < SIGNATURE_V2 {
+		return nil, ErrSignatureVersion
+	}
+
+	return DeviceKeyAt(uuid, device, date, time.Now())
+}
@@ -0,0 +1,263 @@
+package thorne
+
+import (
+
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+
+	"golang.org/x/crypto/hkdf"
+
+)
+
+// ******************************************************
+// Streaming Encryption
+// Seals data of any size in fixed size chunks so it never has to
+// sit in memory, each chunk carries its position and the last one
+// is marked so reordering, truncation and extension all fail
+// ******************************************************
+
+// starts every stream, followed by the chunk size and the salt for the stream key
+const STREAM_HEADER = "\x00TS1"
+
+const STREAM_CHUNK_SIZE = 64 * 1024
+const STREAM_MAX_CHUNK_SIZE = 16 * 1024 * 1024
+
+const streamSaltSize = 32
+const streamHeaderSize = len(STREAM_HEADER) + 4 + streamSaltSize
+
+var ErrStreamCorrupt 			= errors.New("Stream failed authentication")
+var ErrStreamTruncated 		= errors.New("Stream ended before its final chunk")
+var ErrStreamTrailing 		= errors.New("Stream has data after its final chunk")
+var ErrStreamClosed 			= errors.New("Stream is closed")
+
+type encryptWriter struct {
+
+	w 											io.Writer
+	aead 										cipher.AEAD
+	ad 											[]byte
+	buf 										[]byte 				// plaintext waiting for a full chunk
+	chunkSize 							int
+	counter 								uint64
+	err 										error
+
+}
+
+type decryptReader struct {
+
+	r 											io.Reader
+	aead 										cipher.AEAD
+	ad 											[]byte
+	buf 										[]byte 				// one chunk of ciphertext
+	plain 									[]byte 				// plaintext not handed out yet
+	counter 								uint64
+	done 										bool 					// the final chunk has been read
+	err 										error
+
+}
+
+// start a stream on w, everything written is sealed with key and additionalData and
+// Close must be called to write the final chunk, w itself is left open
+func NewEncryptWriter(w io.Writer, key []byte, additionalData []byte) (io.WriteCloser, error) {
+
+	header := make([]byte, streamHeaderSize)
+	copy(header, STREAM_HEADER)
+	binary.BigEndian.PutUint32(header[len(STREAM_HEADER):], STREAM_CHUNK_SIZE)
+	if _, e := io.ReadFull(rand.Reader, header[len(STREAM_HEADER) + 4:]); e != nil {
+		log.Printf("Failed to read from crypto/rand: %s", e)
+		return nil, e
+	}
+
+	aead, e := streamCipher(key, header)
+	if e != nil {
+		return nil, e
+	}
+
+	if _, e := w.Write(header); e != nil {
+		return nil, e
+	}
+
+	return &encryptWriter{w: w, aead: aead, ad: encodeFields(additionalData, header), buf: make([]byte, 0, STREAM_CHUNK_SIZE), chunkSize: STREAM_CHUNK_SIZE}, nil
+}
+
+func (sw *encryptWriter) Write(p []byte) (int, error) {
+
+	written := 0
+	for len(p) > 0 {
+
+		if sw.err != nil {
+			return written, sw.err
+		}
+
+		// only seal a full chunk once more data shows up, it might be the last one
+		if len(sw.buf) == sw.chunkSize {
+			if sw.err = sw.flush(false); sw.err != nil {
+				return written, sw.err
+			}
+		}
+
+		n := copy(sw.buf[len(sw.buf):sw.chunkSize], p)
+		sw.buf = sw.buf[:len(sw.buf) + n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (sw *encryptWriter) Close() error {
+
+	if sw.err != nil {
+		return sw.err
+	}
+
+	e := sw.flush(true)
+	wipe(sw.buf[:cap(sw.buf)])
+
+	sw.err = ErrStreamClosed
+	return e
+}
+
+func (sw *encryptWriter) flush(last bool) error {
+
+	if sw.counter == 1 << 63 {
+		return ErrStreamCorrupt
+	}
+
+	_, e := sw.w.Write(sw.aead.Seal(nil, streamNonce(sw.counter, last), sw.buf, sw.ad))
+	sw.counter++
+	sw.buf = sw.buf[:0]
+
+	return e
+}
+
+// read a stream written by NewEncryptWriter, each chunk is checked before it is returned
+// but a stream is only whole once Read reports io.EOF so anything read before an error
+// must be thrown away
+func NewDecryptReader(r io.Reader, key []byte, additionalData []byte) (io.Reader, error) {
+
+	header := make([]byte, streamHeaderSize)
+	if _, e := io.ReadFull(r, header); e != nil {
+		return nil, ErrStreamTruncated
+	}
+
+	if string(header[:len(STREAM_HEADER)]) != STREAM_HEADER {
+		return nil, ErrStreamCorrupt
+	}
+
+	chunkSize := int(binary.BigEndian.Uint32(header[len(STREAM_HEADER):]))
+	if chunkSize <= 0 || chunkSize > STREAM_MAX_CHUNK_SIZE {
+		return nil, ErrStreamCorrupt
+	}
+
+	aead, e := streamCipher(key, header)
+	if e != nil {
+		return nil, e
+	}
+
+	return &decryptReader{r: r, aead: aead, ad: encodeFields(additionalData, header), buf: make([]byte, chunkSize + aead.Overhead())}, nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+
+	for len(dr.plain) == 0 {
+
+		if dr.err != nil {
+			return 0, dr.err
+		}
+
+		if dr.done {
+			return 0, io.EOF
+		}
+
+		dr.err = dr.next()
+	}
+
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+
+	return n, nil
+}
+
+func (dr *decryptReader) next() error {
+
+	n, e := io.ReadFull(dr.r, dr.buf)
+	if e == io.EOF {
+		return ErrStreamTruncated
+	}
+
+	if e != nil && e != io.ErrUnexpectedEOF {
+		return e
+	}
+
+	// a full chunk might still be the last one, a short one has to be
+	if e == nil {
+		if plain, e := dr.aead.Open(dr.plain[:0], streamNonce(dr.counter, false), dr.buf[:n], dr.ad); e == nil {
+			dr.plain = plain
+			dr.counter++
+			return nil
+		}
+	}
+
+	plain, e := dr.aead.Open(dr.plain[:0], streamNonce(dr.counter, true), dr.buf[:n], dr.ad)
+	if e != nil {
+		return ErrStreamCorrupt
+	}
+
+	// nothing may follow the final chunk
+	if m, _ := dr.r.Read(make([]byte, 1)); m > 0 {
+		return ErrStreamTrailing
+	}
+
+	dr.plain = plain
+	dr.done = true
+	return nil
+}
+
+// the size of the stream NewEncryptWriter writes for size bytes of plaintext
+func EncryptedStreamSize(size int64) int64 {
+
+	chunks := (size + STREAM_CHUNK_SIZE - 1) / STREAM_CHUNK_SIZE
+	if chunks == 0 {
+		chunks = 1
+	}
+
+	return int64(streamHeaderSize) + size + chunks * 16
+}
+
+// every stream gets its own key so the chunk counter can stand in for a random nonce
+func streamCipher(key []byte, header []byte) (cipher.AEAD, error) {
+
+	kdf := hkdf.New(sha256.New, key, header[len(STREAM_HEADER) + 4:], []byte("thorne/stream"))
+
+	k := make([]byte, 32)
+	defer wipe(k)
+	if _, e := io.ReadFull(kdf, k); e != nil {
+		log.Printf("Failed to read from HKDF: %s", e)
+		return nil, e
+	}
+
+	block, e := aes.NewCipher(k)
+	if e != nil {
+		log.Printf("Failed to create AES Cipher: %s", e)
+		return nil, e
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func streamNonce(counter uint64, last bool) []byte {
+
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:], counter)
+	if last {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
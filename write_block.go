@@ -3,17 +3,26 @@ package thorne
 import (
 
 	"bytes"
+	"crypto"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"time"
 
 )
 
 var ErrNotFound 				= errors.New("Ledger Not Found")
+var ErrStaleParent 			= errors.New("Block's Parent is no longer the Ledger's Last Block")
+
+// how many times a v3 block is signed over a newer parent when others keep writing first
+var BlockWriteRetries = 3
 
 func SendMessage(ks *KeyStore, ledger string, content string) error {
 
@@ -29,22 +38,141 @@ func SendMessage(ks *KeyStore, ledger string, content string) error {
 }
 
 func WriteBlock(ks *KeyStore, ledgerUUID string, blockType string, content string) error {
+	_, e := writeBlock(ks, ledgerUUID, blockType, content, nil, SignatureVersion)
+	return e
+}
+
+// write a block with files attached, the block is signed over each file's hash and size
+// and the files themselves are uploaded to the URLs the API hands back for them
+func WriteBlockWithAttachments(ks *KeyStore, ledgerUUID string, blockType string, content string, files []AttachmentFile) error {
+
+	attachments := []BlockAttachment{}
+	for _, f := range files {
+		a, e := f.attachment()
+		if e != nil {
+			log.Printf("Failed to read Attachment %s: %s", f.Name, e)
+			return e
+		}
+		attachments = append(attachments, BlockAttachment{Attachment: a})
+	}
+
+	// only v3 covers the attachments
+	version := SignatureVersion
+	if version < SIGNATURE_V3 {
+		version = SIGNATURE_V3
+	}
+
+	resp, e := writeBlock(ks, ledgerUUID, blockType, content, attachments, version)
+	if e != nil {
+		return e
+	}
+
+	if len(resp.AttachmentURLs) != len(files) {
+		return fmt.Errorf("Expected %d Attachment URLs but got %d", len(files), len(resp.AttachmentURLs))
+	}
+
+	for i, f := range files {
+		if _, e := f.Content.Seek(0, io.SeekStart); e != nil {
+			return e
+		}
+
+		if e := UploadAttachment(ks, ledgerUUID, f.Name, resp.AttachmentURLs[i], f.Content, int64(attachments[i].Attachment.Size)); e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+func writeBlock(ks *KeyStore, ledgerUUID string, blockType string, content string, attachments []BlockAttachment, version int) (*BlockResponse, error) {
+
+	br, release, e := prepareBlock(ks, ledgerUUID, blockType, content, attachments, version)
+	if e != nil {
+		return nil, e
+	}
+
+	for i := 0; ; i++ {
+		resp, e := SubmitBlock(ks, br)
+		if e != ErrStaleParent || i >= BlockWriteRetries {
+			// the API turned it away so its ratchet key can go to the next block. when the
+			// connection failed it may have been written anyway
+			var ne net.Error
+			if e != nil && release != nil && !errors.As(e, &ne) {
+				release()
+			}
+			return resp, e
+		}
+
+		// someone else wrote first so sign over their block and go again, the contents stay as sealed
+		log.Printf("Ledger %s moved on while writing, signing over the new Last Block", ledgerUUID)
+		if e := parentBlock(ks, br); e != nil {
+			if release != nil {
+				release()
+			}
+			return nil, e
+		}
+	}
+}
+
+// seal and sign a block without sending it so others can co-sign it first. on a ratcheting
+// ledger the block has its own message key whether or not it's ever submitted
+func PrepareBlock(ks *KeyStore, ledgerUUID string, blockType string, content string) (*BlockRequest, error) {
+
+	// co-signatures are made over the author's payload so it has to be unambiguous
+	version := SignatureVersion
+	if version < SIGNATURE_V2 {
+		version = SIGNATURE_V2
+	}
+
+	br, _, e := prepareBlock(ks, ledgerUUID, blockType, content, nil, version)
+	return br, e
+}
+
+// along with the block comes a func to hand back its ratchet message key if it never gets written
+func prepareBlock(ks *KeyStore, ledgerUUID string, blockType string, content string, attachments []BlockAttachment, version int) (*BlockRequest, func(), error) {
 
 	ledger, _ := GetLedger(ks, ledgerUUID)
 	body := []byte{}
+	date := time.Now().UTC().Format(time.RFC3339)
+
+	var release func()
+	failed := func(e error) (*BlockRequest, func(), error) {
+		if release != nil {
+			release()
+		}
+		return nil, nil, e
+	}
 
 	if ledger == nil || ledger.LedgerType == LEDGER_TYPE_PUBLIC || ledger.LedgerType == LEDGER_TYPE_REQUESTS {
 		body = []byte(content)
-	} else if key, ok := ks.LedgerKeys[ledgerUUID]; ok {
-		cipher, nonce, e := Crypt(key.SharedSecret, []byte(content))
-		if e != nil {
+	} else if key, ok := ks.LedgerKey(ledgerUUID); ok {
+		var e error
+		// ratchet setup and rotations stay on the ledger key so the other side can always read them,
+		// a device that can't ratchet mustn't fall back to the ledger key for anything else
+		if key.Ratchet != nil && (key.Ratchet.SendChain != nil || !ownsRatchet(ks)) && blockType != RatchetInitType && blockType != KeyRotationType {
+			if body, release, e = ratchetSealBlock(ks, ledgerUUID, blockType, date, []byte(content)); e != nil {
+				log.Printf("Failed to Encrypt Content: %s", e)
+				return nil, nil, e
+			}
+		} else {
+			// rotations still have to go out when the key is used up since they're what replaces it
+			if key, e = reserveKeyUse(ks, ledgerUUID, blockType == KeyRotationType); e != nil {
+				return nil, nil, e
+			}
+
+			if body, e = SealBlock(key.SharedSecret, key.Epoch, ledgerUUID, ks.UUID, blockType, date, []byte(content)); e != nil {
+				log.Printf("Failed to Encrypt Content: %s", e)
+				return nil, nil, e
+			}
+		}
+	} else if ks.LedgerCipher != nil {
+		var e error
+		if body, e = ks.LedgerCipher.LedgerEncrypt(ledgerUUID, blockType, date, []byte(content)); e != nil {
 			log.Printf("Failed to Encrypt Content: %s", e)
-			return e
+			return nil, nil, e
 		}
-		body = append(body, nonce...)
-		body = append(body, cipher...)
 	} else {
-		return fmt.Errorf("No Ledger Key for UUID: %s", ledgerUUID)
+		return nil, nil, fmt.Errorf("No Ledger Key for UUID: %s", ledgerUUID)
 	}
 
 	bodyBase64 := ""
@@ -54,19 +182,183 @@ func WriteBlock(ks *KeyStore, ledgerUUID string, blockType string, content strin
 	} else {
 		bodyBase64 = base64.StdEncoding.EncodeToString(body)
 	}
-	
-	date := time.Now().UTC().Format(time.RFC3339)
-	b := NewBlock{UUID: ks.UUID, Ledger: ledgerUUID, Date: date, Contents: bodyBase64, BlockType: blockType}
 
-	br := BlockRequest{Block: b, Signature: base64.StdEncoding.EncodeToString(GenerateSignature(ks.PrivateKey, []byte(ks.UUID + ledgerUUID + bodyBase64 + date + blockType)))}
+	signer, device, e := ks.signerFor(version)
+	if e != nil {
+		return failed(e)
+	}
+
+	br := BlockRequest{Block: NewBlock{UUID: ks.UUID, Ledger: ledgerUUID, Date: date, Contents: bodyBase64, Attachments: attachments, BlockType: blockType, Device: device}, SignatureVersion: version}
+
+	// v3 signs the ledger's last block so the API can't hang this one anywhere else in the chain
+	if version >= SIGNATURE_V3 && ledger != nil {
+		if br.ParentBlock, e = lastBlock(ks, ledgerUUID); e != nil {
+			return failed(e)
+		}
+	}
+
+	if e := signBlock(signer, &br); e != nil {
+		return failed(e)
+	}
+
+	return &br, release, nil
+}
+
+func signBlock(signer crypto.Signer, br *BlockRequest) error {
+
+	payload, e := blockSigningPayload(br.SignatureVersion, br)
+	if e != nil {
+		log.Printf("Failed to build Block Signing Payload: %s", e)
+		return e
+	}
+
+	signature, e := GenerateSignature(signer, payload)
+	if e != nil {
+		return e
+	}
+
+	br.Signature = base64.StdEncoding.EncodeToString(signature)
+	return nil
+}
+
+// sign a v3 block again over the ledger's current last block
+func parentBlock(ks *KeyStore, br *BlockRequest) error {
+
+	signer, _, e := ks.signerFor(br.SignatureVersion)
+	if e != nil {
+		return e
+	}
+
+	if br.ParentBlock, e = lastBlock(ks, br.Block.Ledger); e != nil {
+		return e
+	}
+
+	return signBlock(signer, br)
+}
+
+// the last block as the API has it now, ours only moves on as we read so it falls behind
+// whenever anyone else writes
+func lastBlock(ks *KeyStore, ledgerUUID string) (string, error) {
+
+	nl, e := fetchLedger(ks, ledgerUUID)
+	if e != nil {
+		return "", e
+	}
+
+	return nl.LastBlock, nil
+}
+
+// send a prepared block to the API along with any co-signatures it has collected. ErrStaleParent
+// means someone wrote first and the block has to be prepared and co-signed again
+func SubmitBlock(ks *KeyStore, br *BlockRequest) (*BlockResponse, error) {
+
+	resp, e := postBlock(&http.Client{}, br)
+	if e != nil {
+		return nil, e
+	}
+
+	if br.Block.BlockType != KeyRotationType {
+		maybeRotateLedgerKey(ks, br.Block.Ledger)
+	}
+
+	return resp, nil
+}
+
+func postBlock(c *http.Client, br *BlockRequest) (*BlockResponse, error) {
+
 	buf, e := json.Marshal(br)
 	if e != nil {
 		log.Printf("Failed to Marshal Block: %s", e)
-		return e
+		return nil, e
 	}
 
-	c := &http.Client{}
 	r, e := http.NewRequest("PUT", "https://thorne.app/api/write", bytes.NewBuffer(buf))
+	if e != nil {
+		log.Printf("Failed to create request: %s", e)
+		return nil, e
+	}
+
+	x, e := c.Do(r)
+	if e != nil {
+		log.Printf("Write Block API Failed: %s", e)
+		return nil, e
+	}
+	defer x.Body.Close()
+
+	// the API turns away v3 blocks whose parent isn't the last block any more
+	if x.StatusCode == http.StatusConflict {
+		return nil, ErrStaleParent
+	}
+
+	if x.StatusCode != 200 {
+		return nil, fmt.Errorf("Failed to write block: %d", x.StatusCode)
+	}
+
+	resp := &BlockResponse{}
+	if buf, e = ioutil.ReadAll(x.Body); e == nil {
+		if e := json.Unmarshal(buf, resp); e != nil {
+			log.Printf("Failed to unmarshal block response: %s", e)
+		}
+	}
+
+	return resp, nil
+}
+
+func GetLedger(ks *KeyStore, ledgerUUID string) (*NewLedger, error) {
+
+	if v, ok := ks.Ledger(ledgerUUID); ok {
+		return &v, nil
+	}
+
+	return nil, ErrNotFound
+}
+
+// like WriteBlock but the content is read from r and streamed to the API so it never has to fit in memory
+func WriteBlockStream(ks *KeyStore, ledgerUUID string, blockType string, content io.Reader) error {
+
+	ledger, _ := GetLedger(ks, ledgerUUID)
+	date := time.Now().UTC().Format(time.RFC3339)
+
+	// the stream can't be signed again so a conflict is left to the caller
+	parent := ""
+	if ledger != nil && SignatureVersion >= SIGNATURE_V3 {
+		var e error
+		if parent, e = lastBlock(ks, ledgerUUID); e != nil {
+			return e
+		}
+	}
+
+	var key *SharedKey
+	if ledger != nil && ledger.LedgerType != LEDGER_TYPE_PUBLIC && ledger.LedgerType != LEDGER_TYPE_REQUESTS {
+		// a LedgerCipher seals whole bodies so there's nothing to stream thru
+		k, ok := ks.LedgerKey(ledgerUUID)
+		if !ok {
+			return fmt.Errorf("No Ledger Key for UUID: %s", ledgerUUID)
+		}
+
+		// streams are sealed with the ledger key so they'd step around the ratchet
+		if k.Ratchet != nil && (k.Ratchet.SendChain != nil || !ownsRatchet(ks)) {
+			return fmt.Errorf("Ledger %s is ratcheting and can't stream blocks", ledgerUUID)
+		}
+
+		// counted like blocks sealed in one piece
+		k, e := reserveKeyUse(ks, ledgerUUID, blockType == KeyRotationType)
+		if e != nil {
+			return e
+		}
+
+		key = &k
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	go func() {
+		pw.CloseWithError(writeBlockRequestStream(pw, ks, ledgerUUID, parent, blockType, date, key, content))
+	}()
+
+	c := &http.Client{}
+	r, e := http.NewRequest("PUT", "https://thorne.app/api/write", pr)
 	if e != nil {
 		log.Printf("Failed to create request: %s", e)
 		return e
@@ -77,21 +369,98 @@ func WriteBlock(ks *KeyStore, ledgerUUID string, blockType string, content strin
 		log.Printf("Write Block API Failed: %s", e)
 		return e
 	}
+	defer x.Body.Close()
+
+	if x.StatusCode == http.StatusConflict {
+		return ErrStaleParent
+	}
 
 	if x.StatusCode != 200 {
 		return fmt.Errorf("Failed to write block: %d", x.StatusCode)
 	}
 
+	if blockType != KeyRotationType {
+		maybeRotateLedgerKey(ks, ledgerUUID)
+	}
+
 	return nil
 }
 
-func GetLedger(ks *KeyStore, ledgerUUID string) (*NewLedger, error) {
+// write a BlockRequest to w hashing the contents on the way thru so they can be signed at the end
+func writeBlockRequestStream(w io.Writer, ks *KeyStore, ledgerUUID string, parentBlock string, blockType string, date string, key *SharedKey, content io.Reader) error {
+
+	// v1 signs the contents as they are and later versions sign their digest, either way they can be hashed as they pass
+	version := SignatureVersion
+	if version < SIGNATURE_V1 || version > SIGNATURE_V3 {
+		return ErrSignatureVersion
+	}
+
+	signer, device, e := ks.signerFor(version)
+	if e != nil {
+		return e
+	}
+
+	br := BlockRequest{Block: NewBlock{UUID: ks.UUID, Ledger: ledgerUUID, Date: date, BlockType: blockType, Device: device}, SignatureVersion: version}
+	if version >= SIGNATURE_V3 {
+		br.ParentBlock = parentBlock
+	}
+
+	hash := sha256.New()
+	if version == SIGNATURE_V1 {
+		hash.Write([]byte(ks.UUID + ledgerUUID))
+	}
+
+	if _, e := fmt.Fprintf(w, `{"ParentBlock":%s,"UID":"","Block":{"UUID":%s,"Ledger":%s,"Contents":"`, jsonString(br.ParentBlock), jsonString(ks.UUID), jsonString(ledgerUUID)); e != nil {
+		return e
+	}
 
-	for _, v := range ks.Ledgers {
-		if v.UUID == ledgerUUID {
-			return &v, nil
+	enc := base64.NewEncoder(base64.StdEncoding, io.MultiWriter(w, hash))
+
+	var body io.Writer = enc
+	var sealed io.WriteCloser
+	if key != nil {
+		var e error
+		if sealed, e = SealBlockStream(enc, key.SharedSecret, key.Epoch, ledgerUUID, ks.UUID, blockType, date); e != nil {
+			log.Printf("Failed to Encrypt Content: %s", e)
+			return e
 		}
+		body = sealed
 	}
 
-	return nil, ErrNotFound
-}
\ No newline at end of file
+	if _, e := io.Copy(body, content); e != nil {
+		log.Printf("Failed to stream Block Contents: %s", e)
+		return e
+	}
+
+	if sealed != nil {
+		if e := sealed.Close(); e != nil {
+			return e
+		}
+	}
+
+	if e := enc.Close(); e != nil {
+		return e
+	}
+
+	var payload []byte
+	if version == SIGNATURE_V1 {
+		hash.Write([]byte(date + blockType))
+		payload = hash.Sum(nil)
+	} else {
+		digest := sha256.Sum256(blockSigningFields(version, &br, hash.Sum(nil)))
+		payload = digest[:]
+	}
+	sig, e := GenerateDigestSignature(signer, payload)
+	if e != nil {
+		return e
+	}
+	signature := base64.StdEncoding.EncodeToString(sig)
+
+	_, e = fmt.Fprintf(w, `","Date":%s,"Attachments":null,"BlockType":%s,"Device":%s},"Signature":%s,"SignatureVersion":%d,"OrgSignatures":null}`, jsonString(date), jsonString(blockType), jsonString(br.Block.Device), jsonString(signature), version)
+	return e
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}